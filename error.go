@@ -0,0 +1,38 @@
+package golex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LexError is the error returned by RunSyncE and TokenStream.Err when a
+// scan ends with a TokenError, giving the failure's coordinates so callers
+// can use errors.As rather than parsing the message.
+type LexError struct {
+	// Name is the name of the lexer that failed
+	Name string
+	// Msg is the message passed to Errorf, without the position prefix
+	Msg string
+	// Offset is the byte offset of the failure, as in Token.Start
+	Offset int
+	// Line and Col locate the failure, both starting at 1
+	Line, Col int
+}
+
+// Error formats the error as the TokenError's value is formatted,
+// as in "name:4:12: unexpected character"
+func (e *LexError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Name, e.Line, e.Col, e.Msg)
+}
+
+// lexError builds a LexError from a TokenError emitted by l
+func (l *Lexer) lexError(tok Token) *LexError {
+	prefix := fmt.Sprintf("%s:%d:%d: ", l.Name, tok.Line, tok.Column)
+	return &LexError{
+		Name:   l.Name,
+		Msg:    strings.TrimPrefix(tok.Val, prefix),
+		Offset: tok.Start,
+		Line:   tok.Line,
+		Col:    tok.Column,
+	}
+}
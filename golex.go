@@ -24,7 +24,7 @@ package golex
 // 			break
 // 		}
 // 	}
-// 	if l.current > l.start {
+// 	if l.Current > l.Start {
 // 		l.Emit(TokenText)
 // 	}
 // 	l.Emit(TokenEOF)
@@ -41,19 +41,69 @@ package golex
 //
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
+	"unsafe"
 )
 
 // represents a token returned from the lexer
 type Token struct {
 	Typ TokenType
 	Val string
+	// Line and Column locate the first rune of the token, both starting at 1.
+	// Columns count runes rather than bytes.
+	Line, Column int
+	// Start and End are the byte offsets of the token in Input, so that
+	// Input[Start:End] is the source text the token was lexed from.
+	// A lexer created with NewAt adds its base offset to both.
+	Start, End int
+}
+
+// NewToken creates a token at the given line and column, for parsers that
+// inject synthetic tokens during error recovery. Start and End are left
+// zero, as a synthetic token has no source text.
+func NewToken(tt TokenType, val string, line, col int) Token {
+	return Token{Typ: tt, Val: val, Line: line, Column: col}
+}
+
+// Equal reports whether two tokens have the same type and value,
+// ignoring their positions
+func (t Token) Equal(other Token) bool {
+	return t.Typ == other.Typ && t.Val == other.Val
+}
+
+// EqualPos is like Equal but also compares positions
+func (t Token) EqualPos(other Token) bool {
+	return t == other
+}
+
+// TokensEqual reports whether two token slices are equal element-wise,
+// comparing tokens with Equal
+func TokensEqual(a, b []Token) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
 }
 
 // tokenType represents the type of tokens
+// Negative values are reserved for the package's sentinels, TokenEOF and
+// TokenError; declare your own token types from zero upwards.
 type TokenType int
 
 const (
@@ -61,22 +111,116 @@ const (
 	TokenError TokenType = -1 // Value contains error text
 )
 
+// EOF is returned by Next and Peek at the end of input.
+// It equals rune(-2), which is never a valid rune, so it can't be
+// confused with a character in the input.
 const EOF = rune(TokenEOF)
 
+// cursor is the part of the lexer's position saved by Mark,
+// alongside the Current it is keyed by
+type cursor struct {
+	start, width int
+}
+
 // Represents the state of the lexer
 // As a function that returns a function
 type StateFn func(*Lexer) StateFn
 
+// Lexer holds the scanning state.
+// State functions may move Start and Current by hand, but should keep
+// 0 <= Start <= Current <= len(Input); Emit reports a TokenError rather
+// than panicking when Start has moved past Current.
 type Lexer struct {
-	Name                  string
-	Input                 string
-	State                 StateFn
-	InitialState          StateFn
+	// number of tokens sent and bytes consumed, accessed atomically;
+	// kept first so they are 64-bit aligned on 32-bit platforms
+	emitted, consumed int64
+
+	Name         string
+	Input        string
+	State        StateFn
+	InitialState StateFn
+	// FinalState, if set, runs once the other states have returned nil and
+	// before the scan ends, giving a single place to emit TokenEOF.
+	// It is skipped when the scan ended with a TokenError.
+	FinalState            StateFn
 	Start, Current, Width int
-	Tokens                chan Token
+	// Tokens carries the tokens of RunConc, RunAsync and RunContext.
+	// RunSync, NextToken and Scan don't send on it.
+	Tokens chan Token
+	// DecodeRune decodes the first rune in s and returns it with its width
+	// in bytes, for lexing input that isn't UTF-8. It defaults to
+	// utf8.DecodeRuneInString when nil, and must make progress on
+	// non-empty input.
+	DecodeRune func(s string) (rune, int)
+	// UserData carries state of the caller's own, such as a brace depth or
+	// lexing mode, through state transitions without package globals.
+	// The lexer never touches it; Reset keeps it and Clone shares it,
+	// except for the data of a TypedLexer, which is copied.
+	UserData interface{}
+
+	// cached position used to compute line and column numbers
+	posOffset, posLine, posColumn int
+	// states saved by PushState
+	stack []StateFn
+	// capacity of the Tokens channel
+	bufSize int
+	// when queued is set, tokens are appended to queue rather than sent on
+	// Tokens, so RunSync never blocks on a full channel
+	queued bool
+	queue  []Token
+	// halted is set by a fatal error; no further tokens are sent and
+	// the scan stops after the current state returns
+	halted bool
+	// strict reports invalid UTF-8 as an error
+	strict bool
+	// trivia is called with the span of input skipped by Ignore
+	trivia func(start, end int)
+	// maxTokenBytes limits the length of an emitted token when non-zero
+	maxTokenBytes int
+	// crlf makes Emit convert "\r\n" to "\n", see SetNewlineNormalize
+	crlf bool
+	// redact blanks the values of emitted tokens, see SetEmitValues
+	redact bool
+	// batchSize, when above 1, makes RunConc send tokens in slices of up to
+	// that many on batches rather than singly on Tokens. batch holds the
+	// tokens not yet sent.
+	batchSize int
+	batch     []Token
+	batches   chan []Token
+	// emit receives tokens in place of the queue or channel during Scan
+	emit func(Token) bool
+	// mu serializes NextTokenSafe. It is a pointer so that Clone can copy
+	// the struct; each lexer gets its own from the constructor.
+	mu *sync.Mutex
+	// closed is closed by Close, once through closeOnce, to stop a running
+	// lexer. closeOnce is separate from mu so a state run by NextTokenSafe
+	// can call Close.
+	closed    chan struct{}
+	closeOnce *sync.Once
+	// cancel is the done channel of the context passed to RunContext
+	cancel <-chan struct{}
+	// trace receives a log of states and tokens, see SetTrace
+	trace io.Writer
+	// last is the most recently emitted token, if hasLast is set
+	last    Token
+	hasLast bool
+	// marks holds the cursor saved by Mark at each marked position
+	marks map[int]cursor
+	// base is added to the offsets of emitted tokens, see NewAt
+	base int
+	// lineIndex caches LineIndex until the input is reset
+	lineIndex []int
+	// finalRun is set once FinalState has been started
+	finalRun bool
 }
 
 func New(name, input string, initialState StateFn) *Lexer {
+	return NewWithBuffer(name, input, initialState, 2)
+}
+
+// NewWithBuffer is like New but sets the capacity of the Tokens channel,
+// which controls how far RunConc can run ahead of its consumer
+func NewWithBuffer(name, input string, initialState StateFn, bufSize int) *Lexer {
 	return &Lexer{
 		Name:         name,
 		Input:        input,
@@ -84,89 +228,885 @@ func New(name, input string, initialState StateFn) *Lexer {
 		InitialState: initialState,
 		Start:        0,
 		Current:      0,
-		Tokens:       make(chan Token, 2),
+		Tokens:       make(chan Token, bufSize),
+		posLine:      1,
+		posColumn:    1,
+		bufSize:      bufSize,
+		mu:           new(sync.Mutex),
+		closed:       make(chan struct{}),
+		closeOnce:    new(sync.Once),
 	}
 }
 
+// NewAt creates a lexer over a fragment of a larger document that starts
+// at byte offset baseOffset within it, such as an embedded script block.
+// The cursor still starts at 0 in input, but the Start and End of emitted
+// tokens are shifted by baseOffset into the document's coordinates.
+// Line and Column remain relative to the fragment.
+func NewAt(name, input string, initialState StateFn, baseOffset int) *Lexer {
+	l := New(name, input, initialState)
+	l.base = baseOffset
+	return l
+}
+
+// NewReader creates a lexer over the contents of r.
+// This does not stream: state functions index Input directly, so r is read to
+// completion before lexing and memory use is still proportional to the input.
+// The data is copied once into a strings.Builder, which grows through append,
+// roughly doubling for small buffers and by about 1.25x once they are large.
+// It does avoid holding a second copy, as converting a []byte to a string would.
+// If reading fails, the lexer emits a TokenError instead of running initialState.
+func NewReader(name string, r io.Reader, initialState StateFn) *Lexer {
+	var b strings.Builder
+	if _, err := io.Copy(&b, r); err != nil {
+		return New(name, b.String(), func(l *Lexer) StateFn {
+			return l.Errorf("reading %s: %v", name, err)
+		})
+	}
+	return New(name, b.String(), initialState)
+}
+
+// NewBytes creates a lexer over input without copying it into a string.
+// Input and the values of emitted tokens share input's memory, so the
+// slice must not be modified while the lexer or its tokens are in use;
+// copy Val with strings.Clone before keeping a token past that point.
+func NewBytes(name string, input []byte, initialState StateFn) *Lexer {
+	return New(name, *(*string)(unsafe.Pointer(&input)), initialState)
+}
+
+// NewFromFile creates a lexer over the contents of the file at path, named
+// after the file's base name. The file is read in one go and the data used
+// without a further copy. An error opening or reading the file is returned
+// wrapped, so it can be checked with errors.Is, as with fs.ErrNotExist.
+func NewFromFile(path string, initialState StateFn) (*Lexer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("golex: %w", err)
+	}
+	return NewBytes(filepath.Base(path), b, initialState), nil
+}
+
+// Reset prepares the lexer to scan a new input from its initial state,
+// as if it had just been created with New.
+// Calling Reset while a previous RunConc is still sending tokens is undefined.
+func (l *Lexer) Reset(input string) {
+	l.Input = input
+	l.State = l.InitialState
+	l.Start, l.Current, l.Width = 0, 0, 0
+	l.Tokens = make(chan Token, l.bufSize)
+	l.closed, l.closeOnce = make(chan struct{}), new(sync.Once)
+	l.posOffset, l.posLine, l.posColumn = 0, 1, 1
+	l.stack = nil
+	l.queued, l.queue = false, nil
+	l.halted = false
+	l.finalRun = false
+	l.last, l.hasLast = Token{}, false
+	l.lineIndex = nil
+	l.marks = nil
+	l.batch = nil
+	if l.batchSize > 1 {
+		l.batches = make(chan []Token, l.bufSize)
+	}
+	atomic.StoreInt64(&l.emitted, 0)
+	atomic.StoreInt64(&l.consumed, 0)
+}
+
+// Restart rewinds the lexer to the start of its current input and back to
+// InitialState, with a fresh Tokens channel, so the same input can be lexed
+// again after an error or after Input has been edited.
+// Restart is not safe for concurrent use: the previous run must have
+// finished, or its remaining tokens be abandoned, before it is called.
+func (l *Lexer) Restart() {
+	l.Reset(l.Input)
+}
+
+// Clone returns a copy of the lexer at its current position and state,
+// with its own Tokens channel, so the two can advance independently.
+// Input is shared, which is safe as it is never modified.
+// Tokens already emitted but not yet read stay with the original, and the
+// clone sends its own tokens on its channel even when cloned during Scan.
+// Whether the scan has ended or run FinalState, and the last token emitted,
+// carry over, as they are part of the position being copied.
+func (l *Lexer) Clone() *Lexer {
+	c := *l
+	c.emit = nil
+	c.Tokens = make(chan Token, l.bufSize)
+	c.stack = append([]StateFn(nil), l.stack...)
+	c.marks = make(map[int]cursor, len(l.marks))
+	for k, v := range l.marks {
+		c.marks[k] = v
+	}
+	c.queued, c.queue = false, nil
+	c.mu = new(sync.Mutex)
+	c.closed, c.closeOnce = make(chan struct{}), new(sync.Once)
+	c.batch = append([]Token(nil), l.batch...)
+	if l.batches != nil {
+		c.batches = make(chan []Token, l.bufSize)
+	}
+	if u, ok := l.UserData.(userDataCloner); ok {
+		c.UserData = u.cloneFor(&c)
+	}
+	return &c
+}
+
+// RunSync runs the lexer to completion before returning.
+// Tokens are held in an internal queue that Listen reads before the
+// Tokens channel, so the channel is never replaced or overfilled.
+// Nothing is sent on Tokens, which is closed empty when RunSync returns:
+// read the tokens with Listen, not by receiving from Tokens. Code that
+// ranged over Tokens after RunSync must switch to Listen or AllTokens.
 func (l *Lexer) RunSync() {
-	l.Tokens = make(chan Token, len(l.Input)/2)
-	l.run()
+	l.queued = true
+	l.run(nil)
 }
 
+// Scan runs the lexer synchronously, passing each token to emit instead of
+// queueing it or sending it on a channel. Returning false from emit stops
+// the scan before another state runs; emit is not called again after that.
+// As with RunConc and NextToken, a TokenEOF is passed if the states finish
+// without emitting one.
+func (l *Lexer) Scan(emit func(Token) bool) {
+	l.emit = emit
+	defer func() { l.emit = nil }()
+	for l.State != nil && !l.halted {
+		l.advance()
+	}
+	l.finish()
+}
+
+// RunConc runs the lexer in a new goroutine, sending tokens on the Tokens
+// channel created by the constructor
 func (l *Lexer) RunConc() {
-	l.Tokens = make(chan Token, len(l.Input)/2)
-	go l.run()
+	go l.run(nil)
+}
+
+// RunContext runs the lexer concurrently until it finishes or ctx is cancelled.
+// Cancellation is checked between state transitions and while blocked
+// sending a token, so the lexer stops even if the consumer has stopped
+// reading; once seen, no further tokens are emitted and the Tokens channel
+// is closed.
+func (l *Lexer) RunContext(ctx context.Context) {
+	go l.run(ctx.Done())
+}
+
+// RunAsync is an alias for RunConc
+func (l *Lexer) RunAsync() {
+	l.RunConc()
 }
 
 // Private run method
-func (l *Lexer) run() {
-	for state := l.InitialState; state != nil; {
-		state = state(l)
+// Stops before the next state transition once done is closed.
+// If the states finish without emitting TokenEOF, or a TokenError ending
+// the scan, an EOF is sent for them so consumers always see the scan end.
+func (l *Lexer) run(done <-chan struct{}) {
+	defer l.closeTokens()
+	l.cancel = done
+	for l.State != nil && !l.halted {
+		select {
+		case <-done:
+			return
+		case <-l.closed:
+			return
+		default:
+			l.advance()
+		}
+	}
+	l.finish()
+	l.flush()
+}
+
+// finish sends a TokenEOF if the states ended without emitting one or
+// failing, so every way of running a scan ends it the same way
+func (l *Lexer) finish() {
+	if !l.failed() && (!l.hasLast || l.last.Typ != TokenEOF) {
+		l.send(l.eofToken())
+	}
+}
+
+// eofToken returns a TokenEOF at the current position, for scans whose
+// states finish without emitting one
+func (l *Lexer) eofToken() Token {
+	line, col := l.position(l.Current)
+	return Token{Typ: TokenEOF, Line: line, Column: col, Start: l.base + l.Current, End: l.base + l.Current}
+}
+
+// closeTokens closes the channels a finished run sends on
+func (l *Lexer) closeTokens() {
+	if l.batches != nil {
+		close(l.batches)
 	}
 	close(l.Tokens)
 }
 
+// advance runs the current state, moving on to FinalState once the
+// states have returned nil without an error
+func (l *Lexer) advance() {
+	if l.trace != nil {
+		fmt.Fprintf(l.trace, "%s: state %s\n", l.Name, stateName(l.State))
+	}
+	l.State = l.step(l.State)
+	if l.State == nil && !l.finalRun && !l.failed() {
+		l.finalRun = true
+		l.State = l.FinalState
+	}
+}
+
+// failed reports whether the scan was halted or its last token was an error
+func (l *Lexer) failed() bool {
+	return l.halted || l.hasLast && l.last.Typ == TokenError
+}
+
+// step runs a single state function, converting a panic into a TokenError
+// that ends the scan so consumers aren't left blocked on the channel
+func (l *Lexer) step(state StateFn) (next StateFn) {
+	defer func() {
+		if r := recover(); r != nil {
+			next = l.Errorf("panic in state function: %v", r)
+		}
+	}()
+	return state(l)
+}
+
 // Listen returns the most recent token received from the channel
-// And a boolean value for if the lexer has finished scanning
+// And a boolean value for if the lexer has finished scanning.
+// A closed Tokens channel reads as a TokenEOF with done set, so a loop on
+// Listen ends even if the states finish without emitting TokenEOF.
 func (l *Lexer) Listen() (t Token, done bool) {
+	if len(l.queue) > 0 {
+		return l.dequeue()
+	}
+	if l.batches != nil {
+		batch, ok := <-l.batches
+		if !ok {
+			return Token{Typ: TokenEOF}, true
+		}
+		l.queue = batch
+		return l.dequeue()
+	}
+	tok, ok := <-l.Tokens
+	if !ok {
+		return Token{Typ: TokenEOF}, true
+	}
+	return tok, tok.Typ == TokenEOF
+}
+
+// TryListen is a non-blocking Listen for consumers that poll, such as an
+// event loop. available is false when no token is ready yet; otherwise
+// t and done are as Listen returns them. A closed Tokens channel reads as
+// a TokenEOF with done set.
+func (l *Lexer) TryListen() (t Token, done, available bool) {
+	if len(l.queue) > 0 {
+		t, done = l.dequeue()
+		return t, done, true
+	}
+	if l.batches != nil {
+		select {
+		case batch, ok := <-l.batches:
+			if !ok {
+				return Token{Typ: TokenEOF}, true, true
+			}
+			l.queue = batch
+			t, done = l.dequeue()
+			return t, done, true
+		default:
+			return Token{}, false, false
+		}
+	}
 	select {
-	case tok := <-l.Tokens:
-		if tok.Typ == TokenEOF {
-			return tok, true
+	case tok, ok := <-l.Tokens:
+		if !ok {
+			return Token{Typ: TokenEOF}, true, true
+		}
+		return tok, tok.Typ == TokenEOF, true
+	default:
+		return Token{}, false, false
+	}
+}
+
+// Close stops a lexer started with RunConc, RunAsync or RunContext. The
+// lexer stops before its next state, or as soon as it is blocked sending a
+// token, and then closes the Tokens channel, so a consumer can abort
+// without a leaked goroutine even if it stops reading. Tokens already on
+// the channel can still be read. Close may be called more than once and
+// from any goroutine.
+func (l *Lexer) Close() {
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+// Drain discards all remaining tokens until the Tokens channel is closed.
+// Call it when you stop consuming a RunConc or RunContext lexer early, so
+// the lexer goroutine isn't left blocked sending and can exit.
+func (l *Lexer) Drain() {
+	l.queue = nil
+	if l.batches != nil {
+		for range l.batches {
 		}
-		return tok, false
+	}
+	for range l.Tokens {
 	}
 }
 
 // Sync method to move through the input and return tokens
+// Tokens are queued internally rather than sent on the Tokens channel, so a
+// state function may emit any number of tokens in one step.
+// Once the state functions have finished, any tokens still queued are
+// returned before a synthetic EOF, so a state that returns nil without
+// emitting TokenEOF still ends the scan.
+// NextToken is for a single consumer; use NextTokenSafe to share a lexer.
 func (l *Lexer) NextToken() (Token, bool) {
-	for {
-		select {
-		case token := <-l.Tokens:
-			if token.Typ == TokenEOF {
-				return token, true
-			} else {
-				return token, false
+	l.fill(1)
+	return l.dequeue()
+}
+
+// NextTokenSafe is like NextToken but may be called from several goroutines
+// at once, for example by a pool of parser workers, each token being
+// returned to exactly one caller. Calls are serialized, so the states still
+// run one at a time. It must not be mixed with other calls that advance the
+// lexer while consumers are running.
+func (l *Lexer) NextTokenSafe() (Token, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.NextToken()
+}
+
+// PeekToken returns the token the next call to NextToken will return,
+// without consuming it.
+func (l *Lexer) PeekToken() (Token, bool) {
+	l.fill(1)
+	tok := l.queue[0]
+	return tok, tok.Typ == TokenEOF
+}
+
+// PeekTokenN returns up to n upcoming tokens without consuming them, for
+// parsers that need more than one token of lookahead. Fewer than n tokens
+// are returned when the scan ends first, the last being its TokenEOF.
+func (l *Lexer) PeekTokenN(n int) []Token {
+	l.fill(n)
+	if n > len(l.queue) {
+		n = len(l.queue)
+	}
+	return append([]Token(nil), l.queue[:n]...)
+}
+
+// Unread pushes a token back so that the next NextToken, PeekToken or
+// Listen returns it before any other. Tokens pushed back in turn are
+// returned last pushed first.
+func (l *Lexer) Unread(tok Token) {
+	l.queue = append([]Token{tok}, l.queue...)
+}
+
+// fill runs the states until n tokens are queued or the scan has ended,
+// in which case a synthetic EOF is queued if the states did not emit one
+func (l *Lexer) fill(n int) {
+	l.queued = true
+	for len(l.queue) < n {
+		if l.State == nil || l.halted {
+			if k := len(l.queue); k == 0 || l.queue[k-1].Typ != TokenEOF {
+				l.queue = append(l.queue, l.eofToken())
 			}
-		default:
-			l.State = l.State(l)
+			return
 		}
+		l.advance()
 	}
 }
 
+// dequeue removes the first queued token
+func (l *Lexer) dequeue() (Token, bool) {
+	tok := l.queue[0]
+	l.queue = l.queue[1:]
+	return tok, tok.Typ == TokenEOF
+}
+
+// AllTokens runs the lexer synchronously and returns every token it emits,
+// ending with the TokenEOF or TokenError that finished the scan.
+// It should be called once on a freshly created lexer.
+func (l *Lexer) AllTokens() []Token {
+	var tokens []Token
+	for {
+		tok, done := l.NextToken()
+		tokens = append(tokens, tok)
+		if done || tok.Typ == TokenError {
+			return tokens
+		}
+	}
+}
+
+// RunSyncE runs the lexer synchronously like AllTokens, but reports a
+// failed scan as a *LexError built from the TokenError. The tokens
+// lexed before the failure are returned, without the error token itself.
+// It should be called once on a freshly created lexer.
+func (l *Lexer) RunSyncE() ([]Token, error) {
+	tokens := l.AllTokens()
+	if last := tokens[len(tokens)-1]; last.Typ == TokenError {
+		return tokens[:len(tokens)-1], l.lexError(last)
+	}
+	return tokens, nil
+}
+
 // Sends token to the Tokens channel and moves starting position to current position
 func (l *Lexer) Emit(tt TokenType) {
-	token := Token{tt, l.Input[l.Start:l.Current]}
-	l.Tokens <- token
+	if !l.checkSpan() {
+		return
+	}
+	l.EmitValue(tt, l.pendingValue())
+}
+
+// pendingValue returns the pending text as Emit sends it, with line
+// endings normalized if SetNewlineNormalize is on
+func (l *Lexer) pendingValue() string {
+	if l.crlf {
+		return strings.ReplaceAll(l.Pending(), "\r\n", "\n")
+	}
+	return l.Pending()
+}
+
+// EmitThen emits a token of type tt and returns next, combining the usual
+// Emit and return at the end of a state function:
+//
+//	return l.EmitThen(TokenOpenBlock, textState)
+func (l *Lexer) EmitThen(tt TokenType, next StateFn) StateFn {
+	l.Emit(tt)
+	return next
+}
+
+// EmitFrom emits a token of type tt spanning from mark, as returned by
+// Mark, to the current position, in place of the pending token. This lets
+// a state fix where a token begins, scan its contents through other
+// states, and emit the whole span at once. A mark past the current
+// position is reported as a TokenError, as Emit does for Start.
+func (l *Lexer) EmitFrom(mark int, tt TokenType) {
+	if mark < 0 {
+		l.Errorf("mark %d is before the start of input", mark)
+		return
+	}
+	l.Start = mark
+	l.Emit(tt)
+}
+
+// EmitRest emits the rest of the input from the start of the pending token
+// as one token of type tt, for fallback states that give up on structure.
+// At the end of input it emits an empty token.
+func (l *Lexer) EmitRest(tt TokenType) {
+	l.Current, l.Width = len(l.Input), 0
+	l.Emit(tt)
+}
+
+// EmitTrimmed is like Emit but sends the scanned text with surrounding
+// whitespace removed, so "{{ name }}" can yield "name". The token's
+// position still covers the untrimmed text.
+func (l *Lexer) EmitTrimmed(tt TokenType) {
+	if !l.checkSpan() {
+		return
+	}
+	l.EmitValue(tt, strings.TrimSpace(l.pendingValue()))
+}
+
+// EmitValue is like Emit but sends val in place of the scanned text,
+// for example the unescaped contents of a string literal.
+// The token's position still covers the scanned text.
+func (l *Lexer) EmitValue(tt TokenType, val string) {
+	if !l.checkSpan() {
+		return
+	}
+	if l.redact {
+		val = ""
+	}
+	line, col := l.position(l.Start)
+	token := Token{
+		Typ:    tt,
+		Val:    val,
+		Line:   line,
+		Column: col,
+		Start:  l.base + l.Start,
+		End:    l.base + l.Current,
+	}
+	l.send(token)
 
 	l.Start = l.Current
 }
 
+// EmitAll sends several fully formed tokens in order and then moves the
+// starting position to the current position, for state functions that
+// produce a burst of tokens from one piece of input
+func (l *Lexer) EmitAll(toks []Token) {
+	for _, t := range toks {
+		l.send(t)
+	}
+	l.Start = l.Current
+}
+
+// EmitMarker sends a token with an empty value at the current position,
+// for tokens such as indentation changes that have no source text.
+// Markers don't consume input, so Start is left where it is and the
+// pending text still belongs to the next token.
+func (l *Lexer) EmitMarker(tt TokenType) {
+	if l.Current > len(l.Input) {
+		l.Current = len(l.Input)
+	}
+	line, col := l.position(l.Current)
+	l.send(Token{
+		Typ:    tt,
+		Line:   line,
+		Column: col,
+		Start:  l.base + l.Current,
+		End:    l.base + l.Current,
+	})
+}
+
+// send delivers a token to the queue or the Tokens channel
+func (l *Lexer) send(t Token) {
+	if l.halted {
+		return
+	}
+	atomic.AddInt64(&l.emitted, 1)
+	atomic.StoreInt64(&l.consumed, int64(l.Current))
+	l.last, l.hasLast = t, true
+	if l.trace != nil {
+		fmt.Fprintf(l.trace, "%s:%d:%d: emit %v %q [%d:%d]\n", l.Name, t.Line, t.Column, t.Typ, t.Val, t.Start, t.End)
+	}
+	switch {
+	case l.emit != nil:
+		if !l.emit(t) {
+			l.halted = true
+		}
+	case l.queued:
+		l.queue = append(l.queue, t)
+	case l.batches != nil:
+		l.batch = append(l.batch, t)
+		if len(l.batch) >= l.batchSize {
+			l.flush()
+		}
+	default:
+		select {
+		case l.Tokens <- t:
+		case <-l.closed:
+			l.halted = true
+		case <-l.cancel:
+			l.halted = true
+		}
+	}
+}
+
+// flush sends any tokens held back for a batch
+func (l *Lexer) flush() {
+	if len(l.batch) > 0 {
+		select {
+		case l.batches <- l.batch:
+		case <-l.closed:
+			l.halted = true
+		case <-l.cancel:
+			l.halted = true
+		}
+		l.batch = nil
+	}
+}
+
+// SetBatchSize makes RunConc, RunAsync and RunContext hand tokens over in
+// batches of up to n, cutting the number of channel operations on large
+// inputs. A batch is sent once full and when the scan ends. Batched tokens
+// are not sent on Tokens, so they must be read with Listen or TryListen,
+// which still return one token at a time. A size of 1 or less sends every
+// token on Tokens as usual. It must be called before the lexer runs.
+func (l *Lexer) SetBatchSize(n int) {
+	l.batchSize = n
+	l.batch = nil
+	l.batches = nil
+	if n > 1 {
+		l.batches = make(chan []Token, l.bufSize)
+	}
+}
+
+// LastToken returns the most recently emitted token and whether any token
+// has been emitted, for context-sensitive states such as telling a regular
+// expression from a division after a '/'.
+func (l *Lexer) LastToken() (Token, bool) {
+	return l.last, l.hasLast
+}
+
+// NumEmitted returns the number of tokens emitted so far.
+// It is safe to call from another goroutine while the lexer runs.
+func (l *Lexer) NumEmitted() int {
+	return int(atomic.LoadInt64(&l.emitted))
+}
+
+// BytesConsumed returns how far into Input the lexer has scanned, as of
+// the last token emitted or input ignored.
+// It is safe to call from another goroutine while the lexer runs, for
+// example to report BytesConsumed()/len(Input) as progress.
+func (l *Lexer) BytesConsumed() int {
+	return int(atomic.LoadInt64(&l.consumed))
+}
+
+// checkSpan clamps Current to the end of Input, so an over-advance produces
+// a truncated token, and reports whether Start..Current is a valid span.
+// An invalid span is reported as a TokenError and discarded, and a span
+// longer than the maximum token length ends the scan.
+func (l *Lexer) checkSpan() bool {
+	if l.Current > len(l.Input) {
+		l.Current = len(l.Input)
+	}
+	if l.Start > l.Current {
+		l.Errorf("token start %d is past current position %d", l.Start, l.Current)
+		l.Start = l.Current
+		return false
+	}
+	if l.maxTokenBytes > 0 && l.Current-l.Start > l.maxTokenBytes {
+		l.fail("token of %d bytes exceeds the maximum of %d", l.Current-l.Start, l.maxTokenBytes)
+		return false
+	}
+	return true
+}
+
+// SetMaxTokenBytes limits the length of emitted tokens to n bytes, as a
+// guard against untrusted input running a single token to the end of file.
+// Emitting a longer token sends a TokenError and ends the scan.
+// Zero, the default, means no limit.
+func (l *Lexer) SetMaxTokenBytes(n int) {
+	l.maxTokenBytes = n
+}
+
 // Emit if current position greater than start position
 func (l *Lexer) CheckEmit(t TokenType) {
-	if l.Current > l.Start {
-		l.Emit(t)
+	l.EmitPending(t)
+}
+
+// EmitPending emits the pending text as a token of type tt if there is any,
+// and reports whether a token was emitted
+func (l *Lexer) EmitPending(tt TokenType) bool {
+	if l.Current <= l.Start {
+		return false
 	}
+	l.Emit(tt)
+	return true
+}
+
+// position returns the line and rune column of the byte offset in Input.
+// Lines are counted lazily here rather than in Next, because state functions
+// may move Current by hand and would otherwise skip the counting.
+// Counting resumes from the last computed position, so monotonically
+// increasing offsets only scan each byte of input once.
+func (l *Lexer) position(offset int) (line, col int) {
+	if offset > len(l.Input) {
+		offset = len(l.Input)
+	}
+	if offset < l.posOffset {
+		l.posOffset, l.posLine, l.posColumn = 0, 1, 1
+	}
+	for rest := l.Input[l.posOffset:offset]; rest != ""; {
+		r, w := l.decode(rest)
+		if r == '\n' {
+			l.posLine++
+			l.posColumn = 1
+		} else {
+			l.posColumn++
+		}
+		rest = rest[w:]
+	}
+	l.posOffset = offset
+	return l.posLine, l.posColumn
+}
+
+// PushState saves a state to resume later with PopState,
+// for example the state to return to once a nested block closes
+func (l *Lexer) PushState(s StateFn) {
+	l.stack = append(l.stack, s)
+}
+
+// PopState removes and returns the most recently pushed state.
+// It returns nil, ending the scan, if the stack is empty.
+func (l *Lexer) PopState() StateFn {
+	if len(l.stack) == 0 {
+		return nil
+	}
+	s := l.stack[len(l.stack)-1]
+	l.stack = l.stack[:len(l.stack)-1]
+	return s
+}
+
+// LineText returns the line of Input containing the byte offset, without
+// its line ending, and the 1-based rune column of the offset within it.
+// It is intended for showing context alongside an error position.
+func (l *Lexer) LineText(offset int) (line string, col int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(l.Input) {
+		offset = len(l.Input)
+	}
+	begin := strings.LastIndexByte(l.Input[:offset], '\n') + 1
+	end := len(l.Input)
+	if i := strings.IndexByte(l.Input[offset:], '\n'); i >= 0 {
+		end = offset + i
+	}
+	line = strings.TrimSuffix(l.Input[begin:end], "\r")
+	return line, l.runeCount(l.Input[begin:offset]) + 1
+}
+
+// LineIndex returns the byte offset in Input at which each line starts, so
+// that line n begins at LineIndex()[n-1]. An offset can be mapped to its
+// line by binary search, for example with sort.SearchInts.
+// The index is built on the first call and cached until Reset; the returned
+// slice is shared and must not be modified.
+func (l *Lexer) LineIndex() []int {
+	if l.lineIndex == nil {
+		l.lineIndex = []int{0}
+		for i := 0; ; {
+			n := strings.IndexByte(l.Input[i:], '\n')
+			if n < 0 {
+				break
+			}
+			i += n + 1
+			l.lineIndex = append(l.lineIndex, i)
+		}
+	}
+	return l.lineIndex
+}
+
+// decode decodes the first rune of s with DecodeRune, or as UTF-8.
+// ASCII is returned directly, skipping the full decoder on the common path.
+func (l *Lexer) decode(s string) (rune, int) {
+	if l.DecodeRune != nil {
+		return l.DecodeRune(s)
+	}
+	if s != "" && s[0] < utf8.RuneSelf {
+		return rune(s[0]), 1
+	}
+	return utf8.DecodeRuneInString(s)
+}
+
+// runeCount returns the number of runes in s as decoded by the lexer
+func (l *Lexer) runeCount(s string) int {
+	if l.DecodeRune == nil {
+		return utf8.RuneCountInString(s)
+	}
+	n := 0
+	for ; s != ""; n++ {
+		_, w := l.DecodeRune(s)
+		s = s[w:]
+	}
+	return n
 }
 
 // Lexer helpers
 func (l *Lexer) Next() rune {
 	var res rune
-	if l.Current >= len(l.Input) {
+	if l.Current >= len(l.Input) || l.halted {
+		l.Width = 0
+		return EOF
+	}
+	res, l.Width = l.decode(l.Input[l.Current:])
+	if res == utf8.RuneError && l.Width == 1 && l.strict {
+		l.fail("invalid UTF-8 encoding at offset %d", l.Current)
 		l.Width = 0
 		return EOF
 	}
-	res, l.Width = utf8.DecodeRuneInString(l.Input[l.Current:])
 	l.Current += l.Width
 	return res
 }
 
+// SetTriviaHandler registers a function called with the byte offsets of
+// any input skipped by Ignore, such as whitespace or comments, so it can be
+// attached to neighbouring tokens. The offsets are shifted by the base
+// offset of NewAt, as token offsets are. Pass nil to remove the handler.
+func (l *Lexer) SetTriviaHandler(h func(start, end int)) {
+	l.trivia = h
+}
+
+// SetEmitValues controls whether emitted tokens carry their text.
+// When false, Emit and EmitValue send tokens with an empty Val but the
+// usual type and position, giving a structure-only stream that is safe to
+// log. Error tokens keep their messages.
+func (l *Lexer) SetEmitValues(emit bool) {
+	l.redact = !emit
+}
+
+// SetNewlineNormalize controls whether Emit, and the helpers built on it
+// such as EmitTrimmed and EmitRest, replace "\r\n" with "\n" in token
+// values. EmitValue sends its value as given. Input is left untouched, so
+// token positions still refer to the original bytes.
+func (l *Lexer) SetNewlineNormalize(normalize bool) {
+	l.crlf = normalize
+}
+
+// SetTrace logs each state the lexer runs, by function name, and each token
+// it emits, with its position, to w. Pass nil to turn tracing off.
+func (l *Lexer) SetTrace(w io.Writer) {
+	l.trace = w
+}
+
+// stateName returns the function name of a state for tracing
+func stateName(s StateFn) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(s).Pointer()); f != nil {
+		return f.Name()
+	}
+	return "unknown"
+}
+
+// SetStrictUTF8 controls whether invalid UTF-8 in the input is an error.
+// When strict, Next emits a TokenError giving the byte offset of the bad
+// sequence and ends the scan, rather than returning utf8.RuneError.
+func (l *Lexer) SetStrictUTF8(strict bool) {
+	l.strict = strict
+}
+
 func (l *Lexer) Ignore() {
+	if l.trivia != nil && l.Current > l.Start {
+		l.trivia(l.base+l.Start, l.base+l.Current)
+	}
 	l.Start = l.Current
+	atomic.StoreInt64(&l.consumed, int64(l.Current))
 }
 
+// Backup steps back over the rune read by the last call to Next.
+// Width is cleared, so further calls are no-ops until Next is called again;
+// use BackupN to step back over several runes.
 func (l *Lexer) Backup() {
 	l.Current -= l.Width
+	l.Width = 0
+}
+
+// Advance moves forward n bytes, stopping at the end of input, and clears
+// Width so a following Backup is a no-op. Prefer it to adding to Current
+// directly, as in Advance(len(openBlock)), which can overrun the input.
+func (l *Lexer) Advance(n int) {
+	l.Current += n
+	if l.Current > len(l.Input) {
+		l.Current = len(l.Input)
+	}
+	if l.Current < l.Start {
+		l.Current = l.Start
+	}
+	l.Width = 0
+}
+
+// ConsumeRunes advances past up to n runes, whatever their width in bytes,
+// and returns how many were consumed, which is fewer than n only at the end
+// of input. Width is left as the last rune's, so Backup steps back over it.
+func (l *Lexer) ConsumeRunes(n int) int {
+	i := 0
+	for ; i < n && l.Next() != EOF; i++ {
+	}
+	return i
+}
+
+// BackupN steps back over up to n runes, stopping at the start of the
+// pending token. Width is cleared afterwards.
+// The pending text is decoded forwards to find rune boundaries, so this
+// works with any DecodeRune.
+func (l *Lexer) BackupN(n int) {
+	var bounds []int
+	for i := l.Start; i < l.Current; {
+		bounds = append(bounds, i)
+		_, w := l.decode(l.Input[i:l.Current])
+		i += w
+	}
+	if n > len(bounds) {
+		n = len(bounds)
+	}
+	if n > 0 {
+		l.Current = bounds[len(bounds)-n]
+	}
+	l.Width = 0
 }
 
 // Returns the next character without moving the lexer forward
@@ -176,6 +1116,64 @@ func (l *Lexer) Peek() rune {
 	return res
 }
 
+// PeekNoMutate returns the next rune without moving the lexer forward.
+// Unlike Peek, which calls Next and Backup and so clears Width, it leaves
+// Width alone, so a Backup planned before peeking still steps back over
+// the rune last read by Next.
+func (l *Lexer) PeekNoMutate() rune {
+	r, _ := l.PeekRune()
+	return r
+}
+
+// PeekRune returns the next rune and its width in bytes without moving the
+// lexer forward, so a state function can advance past it by adding width
+// to Current. It returns EOF and 0 at the end of input.
+func (l *Lexer) PeekRune() (r rune, width int) {
+	if l.Current >= len(l.Input) {
+		return EOF, 0
+	}
+	return l.decode(l.Input[l.Current:])
+}
+
+// PeekWord returns the upcoming run of letters, digits and '_' without
+// moving the lexer forward, so a state can tell a keyword from an
+// identifier before consuming it. It returns "" if no word follows.
+func (l *Lexer) PeekWord() string {
+	rest := l.Input[l.Current:]
+	n := 0
+	for n < len(rest) {
+		r, w := l.decode(rest[n:])
+		if !isIdentPart(r) {
+			break
+		}
+		n += w
+	}
+	return rest[:n]
+}
+
+// PeekIs reports whether the next rune satisfies pred without moving the
+// lexer forward. It returns false at the end of input.
+func (l *Lexer) PeekIs(pred func(rune) bool) bool {
+	if l.Current >= len(l.Input) {
+		return false
+	}
+	r, _ := l.decode(l.Input[l.Current:])
+	return pred(r)
+}
+
+// PeekN returns up to n upcoming runes without moving the lexer forward.
+// Fewer than n runes are returned when the input ends first.
+func (l *Lexer) PeekN(n int) []rune {
+	runes := make([]rune, 0, n)
+	for rest := l.Input[l.Current:]; len(runes) < n && rest != ""; {
+		r, w := l.decode(rest)
+		runes = append(runes, r)
+		rest = rest[w:]
+	}
+	return runes
+}
+
+// Accept consumes the next rune if it is one of the runes in valid
 func (l *Lexer) Accept(valid string) bool {
 	if strings.IndexRune(valid, l.Next()) >= 0 {
 		return true
@@ -184,12 +1182,109 @@ func (l *Lexer) Accept(valid string) bool {
 	return false
 }
 
+// AcceptRune consumes the next rune if it is r
+func (l *Lexer) AcceptRune(r rune) bool {
+	if l.Next() == r {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRange consumes the next rune if it lies between lo and hi inclusive
+func (l *Lexer) AcceptRange(lo, hi rune) bool {
+	if r := l.Next(); r != EOF && lo <= r && r <= hi {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRangeRun consumes a run of runes between lo and hi inclusive and
+// returns how many it consumed
+func (l *Lexer) AcceptRangeRun(lo, hi rune) int {
+	n := 0
+	for l.AcceptRange(lo, hi) {
+		n++
+	}
+	return n
+}
+
+// AcceptRun consumes a run of runes from valid, stopping on the first
+// rune that isn't in it
 func (l *Lexer) AcceptRun(valid string) {
 	for strings.IndexRune(valid, l.Next()) >= 0 {
 	}
 	l.Backup()
 }
 
+// AcceptWhile consumes runes while pred reports true and returns how many
+// were consumed, leaving the lexer on the first rune that didn't match
+func (l *Lexer) AcceptWhile(pred func(rune) bool) int {
+	n := 0
+	for r := l.Next(); r != EOF && pred(r); r = l.Next() {
+		n++
+	}
+	l.Backup()
+	return n
+}
+
+// AcceptUntil advances to the next occurrence of delim without consuming it,
+// or to the end of input if delim isn't found, and reports whether it was found
+func (l *Lexer) AcceptUntil(delim string) bool {
+	l.Width = 0
+	i := strings.Index(l.Input[l.Current:], delim)
+	if i < 0 {
+		l.Current = len(l.Input)
+		return false
+	}
+	l.Current += i
+	return true
+}
+
+// SkipTo advances to the next r without consuming it, or to the end of
+// input if there is none, and reports whether r was found. It is useful
+// for error recovery, such as skipping to the next ';'.
+func (l *Lexer) SkipTo(r rune) bool {
+	l.Width = 0
+	rest := l.Input[l.Current:]
+	if l.DecodeRune == nil {
+		if i := strings.IndexRune(rest, r); i >= 0 {
+			l.Current += i
+			return true
+		}
+		l.Current = len(l.Input)
+		return false
+	}
+	for i := 0; i < len(rest); {
+		c, w := l.decode(rest[i:])
+		if c == r {
+			l.Current += i
+			return true
+		}
+		i += w
+	}
+	l.Current = len(l.Input)
+	return false
+}
+
+// AcceptUntilOrError is like AcceptUntil but for delimiters that must be
+// present. It returns nil if delim was found, otherwise a state that
+// reports "unterminated <what>" with Errorf, as ExpectRune does.
+func (l *Lexer) AcceptUntilOrError(delim, what string) StateFn {
+	if l.AcceptUntil(delim) {
+		return nil
+	}
+	return errorState("unterminated %s", what)
+}
+
+// SkipSpaces consumes any run of whitespace and ignores it
+func (l *Lexer) SkipSpaces() {
+	l.AcceptWhile(IsSpace)
+	l.Ignore()
+}
+
+// Rune predicates for use in state functions and with AcceptWhile
 func IsSpace(r rune) bool {
 	return unicode.IsSpace(r)
 }
@@ -198,17 +1293,165 @@ func IsAlpha(r rune) bool {
 	return unicode.IsLetter(r)
 }
 
+func IsDigit(r rune) bool {
+	return unicode.IsDigit(r)
+}
+
+func IsAlphaNumeric(r rune) bool {
+	return IsAlpha(r) || IsDigit(r)
+}
+
 func (l *Lexer) NextHasPrefix(prefix string) bool {
-	next := l.Input[l.Current:]
-	return strings.HasPrefix(next, prefix)
+	return strings.HasPrefix(l.Remaining(), prefix)
+}
+
+// AcceptString consumes s if the remaining input starts with it
+func (l *Lexer) AcceptString(s string) bool {
+	if !l.NextHasPrefix(s) {
+		return false
+	}
+	l.Current += len(s)
+	l.Width = 0
+	return true
+}
+
+// NextHasPrefixFold is like NextHasPrefix but compares runes under Unicode
+// case folding, as strings.EqualFold does
+func (l *Lexer) NextHasPrefixFold(prefix string) bool {
+	rest := l.Remaining()
+	for _, pr := range prefix {
+		if rest == "" {
+			return false
+		}
+		r, w := l.decode(rest)
+		if !equalFold(r, pr) {
+			return false
+		}
+		rest = rest[w:]
+	}
+	return true
+}
+
+// equalFold reports whether a and b are equal under simple case folding
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for r := unicode.SimpleFold(a); r != a; r = unicode.SimpleFold(r) {
+		if r == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Pos returns the cursor: the start of the pending token, the current
+// position and the width of the last rune read by Next
+func (l *Lexer) Pos() (start, current, width int) {
+	return l.Start, l.Current, l.Width
+}
+
+// Mark saves the cursor, Start, Current and Width, for a later call to
+// Rewind, and returns the position it was saved at. Marks are kept per
+// position, so a later Mark at the same position replaces the earlier one.
+func (l *Lexer) Mark() int {
+	if l.marks == nil {
+		l.marks = make(map[int]cursor)
+	}
+	l.marks[l.Current] = cursor{start: l.Start, width: l.Width}
+	return l.Current
+}
+
+// Rewind restores the cursor saved by Mark, so a speculative scan can be
+// abandoned. Only the cursor moves: tokens emitted since the mark are not
+// taken back. A position that wasn't marked moves Current there, moving
+// Start back too if it has passed it, and clears Width. A mark outside the
+// input is reported as a TokenError and the cursor is left alone.
+func (l *Lexer) Rewind(mark int) {
+	if mark < 0 || mark > len(l.Input) {
+		l.Errorf("mark %d is outside the input", mark)
+		return
+	}
+	l.Current = mark
+	if c, ok := l.marks[mark]; ok {
+		l.Start, l.Width = c.start, c.width
+		return
+	}
+	if l.Start > mark {
+		l.Start = mark
+	}
+	l.Width = 0
+}
+
+// Pending returns the text scanned since the last Emit or Ignore,
+// which is the value the next call to Emit will send
+func (l *Lexer) Pending() string {
+	return l.Input[l.Start:l.Current]
+}
+
+// Remaining returns the input that hasn't been consumed yet.
+// The returned string shares its backing memory with Input.
+func (l *Lexer) Remaining() string {
+	return l.Input[l.Current:]
+}
+
+// RemainingBytes returns the number of bytes of input not yet consumed
+func (l *Lexer) RemainingBytes() int {
+	return len(l.Input) - l.Current
+}
+
+// RemainingRunes returns the number of runes of input not yet consumed.
+// It counts the remaining input on each call, so it is O(n) in its length.
+func (l *Lexer) RemainingRunes() int {
+	return l.runeCount(l.Remaining())
 }
 
 // Returns an error token and terminates the scan
 // By passing nil pointer which will become the next state, terminating run loop
+// The message is prefixed with the lexer name and current position,
+// as in "name:4:12: unexpected character"
 func (l *Lexer) Errorf(format string, args ...interface{}) StateFn {
-	l.Tokens <- Token{
-		TokenError,
-		fmt.Sprintf(format, args...),
-	}
+	line, col := l.position(l.Current)
+	l.send(Token{
+		Typ:    TokenError,
+		Val:    fmt.Sprintf("%s:%d:%d: %s", l.Name, line, col, fmt.Sprintf(format, args...)),
+		Line:   line,
+		Column: col,
+		Start:  l.base + l.Current,
+		End:    l.base + l.Current,
+	})
 	return nil
 }
+
+// fail emits an error token and halts the lexer, so state functions that
+// can't return a state themselves still end the scan
+func (l *Lexer) fail(format string, args ...interface{}) {
+	l.Errorf(format, args...)
+	l.halted = true
+}
+
+// ExpectRune consumes the next rune if it is r and returns nil.
+// Otherwise it consumes nothing and returns a state that reports the
+// mismatch with Errorf, so callers can write
+//
+//	if s := l.ExpectRune(')'); s != nil {
+//		return s
+//	}
+func (l *Lexer) ExpectRune(r rune) StateFn {
+	switch next := l.Next(); next {
+	case r:
+		return nil
+	case EOF:
+		return errorState("unexpected end of input, expected %q", r)
+	default:
+		l.Backup()
+		return errorState("unexpected %q, expected %q", next, r)
+	}
+}
+
+// errorState returns a state that reports an error with Errorf when run
+func errorState(format string, args ...interface{}) StateFn {
+	return func(l *Lexer) StateFn {
+		return l.Errorf(format, args...)
+	}
+}
@@ -1,8 +1,19 @@
 package golex
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 const testString = "<div>{{name}}</div>"
@@ -141,6 +152,16 @@ func TestLex(t *testing.T) {
 		}
 	})
 
+	t.Run("Using RunSync() Method with empty input", func(t *testing.T) {
+		l := New("test", "", mockTextStateFn)
+		l.RunSync()
+
+		tok, done := l.Listen()
+		if !done || tok.Typ != TokenEOF {
+			t.Errorf("Expected a single EOF token, got %v", tok)
+		}
+	})
+
 	t.Run("Using RunConc() Method", func(t *testing.T) {
 		l := New("test", string(f), mockTextStateFn)
 		l.RunConc()
@@ -155,4 +176,2319 @@ func TestLex(t *testing.T) {
 			received = append(received, tok)
 		}
 	})
+
+	t.Run("Using RunAsync() Method", func(t *testing.T) {
+		l := New("test", string(f), mockTextStateFn)
+		l.RunAsync()
+
+		var received []Token
+		for {
+			tok, done := l.Listen()
+			if done {
+				t.Logf("Total Tokens: %o", len(received))
+				return
+			}
+			received = append(received, tok)
+		}
+	})
+}
+
+func TestTokenPosition(t *testing.T) {
+	l := New("test", "<p>\n{{é}}o", mockTextStateFn)
+
+	var received []Token
+	for {
+		token, done := l.NextToken()
+		received = append(received, token)
+		if done {
+			break
+		}
+	}
+
+	expected := []struct {
+		val          string
+		line, column int
+		start, end   int
+	}{
+		{"<p>", 1, 1, 0, 3},
+		{"\n", 1, 4, 3, 4},
+		{"{{", 2, 1, 4, 6},
+		{"é", 2, 3, 6, 8},
+		{"}}", 2, 4, 8, 10},
+		{"o", 2, 6, 10, 11},
+		{"", 2, 7, 11, 11},
+	}
+
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d", len(expected), len(received))
+	}
+	for i, e := range expected {
+		tok := received[i]
+		if tok.Val != e.val || tok.Line != e.line || tok.Column != e.column {
+			t.Errorf("token %d: expected %q at %d:%d, got %q at %d:%d", i, e.val, e.line, e.column, tok.Val, tok.Line, tok.Column)
+		}
+		if tok.Start != e.start || tok.End != e.end {
+			t.Errorf("token %d: expected offsets [%d:%d], got [%d:%d]", i, e.start, e.end, tok.Start, tok.End)
+		}
+		if src := l.Input[tok.Start:tok.End]; src != tok.Val {
+			t.Errorf("token %d: offsets [%d:%d] cover %q, expected %q", i, tok.Start, tok.End, src, tok.Val)
+		}
+	}
+	if eof := received[len(received)-1]; eof.Typ != TokenEOF {
+		t.Errorf("Expected final token to be EOF, got %v", eof)
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	errorStateFn := func(l *Lexer) StateFn {
+		l.AcceptRun("ab\né")
+		return l.Errorf("unexpected %q", l.Peek())
+	}
+
+	t.Run("Error token carries the current line and column", func(t *testing.T) {
+		l := New("test", "ab\néa}", errorStateFn)
+		tok, _ := l.NextToken()
+
+		if tok.Typ != TokenError {
+			t.Fatalf("Expected error token, got %v", tok)
+		}
+		if tok.Line != 2 || tok.Column != 3 {
+			t.Errorf("Expected error at 2:3, got %d:%d", tok.Line, tok.Column)
+		}
+		if tok.Start != 6 || tok.End != 6 {
+			t.Errorf("Expected error offsets [6:6], got [%d:%d]", tok.Start, tok.End)
+		}
+		if tok.Val != `test:2:3: unexpected '}'` {
+			t.Errorf("Expected error message to include the position, got %q", tok.Val)
+		}
+	})
+
+	t.Run("Error after advancing past the input does not panic", func(t *testing.T) {
+		l := New("test", "ab", func(l *Lexer) StateFn {
+			l.Current += 10
+			return l.Errorf("overrun")
+		})
+		tok, _ := l.NextToken()
+
+		if tok.Typ != TokenError || tok.Line != 1 || tok.Column != 3 {
+			t.Errorf("Expected error at 1:3, got %v at %d:%d", tok, tok.Line, tok.Column)
+		}
+	})
+}
+
+func TestReset(t *testing.T) {
+	l := New("test", "first {{input}}", mockTextStateFn)
+	l.RunSync()
+	for {
+		if _, done := l.Listen(); done {
+			break
+		}
+	}
+
+	l.Reset(testString)
+	l.RunSync()
+
+	var out string
+	for {
+		tok, done := l.Listen()
+		if done {
+			break
+		}
+		out += tok.String()
+	}
+
+	if out != testString {
+		t.Errorf("Expected reset lexer to scan %q, got %q", testString, out)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	t.Run("Lexes the reader contents", func(t *testing.T) {
+		l := NewReader("test", strings.NewReader(testString), mockTextStateFn)
+
+		var out string
+		for {
+			tok, done := l.NextToken()
+			if done {
+				break
+			}
+			out += tok.String()
+		}
+
+		if out != testString {
+			t.Errorf("Expected %q, got %q", testString, out)
+		}
+	})
+
+	t.Run("Read failure emits an error token", func(t *testing.T) {
+		l := NewReader("test", iotest.ErrReader(errors.New("boom")), mockTextStateFn)
+		l.RunSync()
+
+		tok, _ := l.Listen()
+		if tok.Typ != TokenError {
+			t.Fatalf("Expected error token, got %v", tok)
+		}
+		if !strings.Contains(tok.Val, "boom") {
+			t.Errorf("Expected error to mention the read failure, got %q", tok.Val)
+		}
+	})
+}
+
+func TestAllTokens(t *testing.T) {
+	t.Run("Returns every token including EOF", func(t *testing.T) {
+		tokens := New("test", testString, mockTextStateFn).AllTokens()
+
+		if len(tokens) != 6 {
+			t.Fatalf("Expected 6 tokens, got %d", len(tokens))
+		}
+		if last := tokens[len(tokens)-1]; last.Typ != TokenEOF {
+			t.Errorf("Expected final token to be EOF, got %v", last)
+		}
+	})
+
+	t.Run("Stops at an error token", func(t *testing.T) {
+		tokens := New("test", "x", func(l *Lexer) StateFn {
+			return l.Errorf("bad input")
+		}).AllTokens()
+
+		if len(tokens) != 1 || tokens[0].Typ != TokenError {
+			t.Errorf("Expected a single error token, got %v", tokens)
+		}
+	})
+}
+
+func TestAcceptWhile(t *testing.T) {
+	l := New("test", "héllo world", nil)
+
+	if n := l.AcceptWhile(IsAlpha); n != 5 {
+		t.Errorf("Expected 5 runes consumed, got %d", n)
+	}
+	if l.Current != len("héllo") {
+		t.Errorf("Expected cursor at %d, got %d", len("héllo"), l.Current)
+	}
+
+	l.Current = len(l.Input)
+	if n := l.AcceptWhile(IsAlpha); n != 0 || l.Current != len(l.Input) {
+		t.Errorf("Expected no runes consumed at EOF, got %d with cursor at %d", n, l.Current)
+	}
+}
+
+func TestAcceptUntil(t *testing.T) {
+	t.Run("Stops before the delimiter", func(t *testing.T) {
+		l := New("test", "näme→→rest", nil)
+		if !l.AcceptUntil("→→") {
+			t.Fatal("Expected delimiter to be found")
+		}
+		if l.Input[l.Start:l.Current] != "näme" || !l.NextHasPrefix("→→") {
+			t.Errorf("Expected to stop before delimiter, pending %q", l.Input[l.Start:l.Current])
+		}
+	})
+
+	t.Run("Consumes the rest when the delimiter is missing", func(t *testing.T) {
+		l := New("test", "name", nil)
+		if l.AcceptUntil("}}") {
+			t.Fatal("Expected delimiter not to be found")
+		}
+		if l.Current != len(l.Input) {
+			t.Errorf("Expected cursor at end of input, got %d", l.Current)
+		}
+	})
+}
+
+func TestNextTokenWithoutEOF(t *testing.T) {
+	l := New("test", "abc", func(l *Lexer) StateFn {
+		l.Current = len(l.Input)
+		l.Emit(TokenText)
+		return nil
+	})
+
+	tok, done := l.NextToken()
+	if done || tok.Val != "abc" {
+		t.Fatalf("Expected text token, got %v (done=%v)", tok, done)
+	}
+	for i := 0; i < 2; i++ {
+		tok, done = l.NextToken()
+		if !done || tok.Typ != TokenEOF {
+			t.Errorf("Expected synthetic EOF, got %v (done=%v)", tok, done)
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	t.Run("Runs to completion", func(t *testing.T) {
+		l := New("test", testString, mockTextStateFn)
+		l.RunContext(context.Background())
+
+		var out string
+		for tok := range l.Tokens {
+			out += tok.String()
+		}
+		if out != testString+"EOF" {
+			t.Errorf("Expected %q, got %q", testString+"EOF", out)
+		}
+	})
+
+	t.Run("Stops and closes the channel when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		steps := 0
+		var loop StateFn
+		loop = func(l *Lexer) StateFn {
+			steps++
+			if steps == 3 {
+				cancel()
+			}
+			return loop
+		}
+
+		l := New("test", "", loop)
+		l.RunContext(ctx)
+
+		for range l.Tokens {
+		}
+		if steps != 3 {
+			t.Errorf("Expected the lexer to stop after 3 steps, ran %d", steps)
+		}
+	})
+
+	t.Run("Stops while blocked sending once cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var sent int32
+		pairStateFn := func(l *Lexer) StateFn {
+			for i := 0; i < 2; i++ {
+				l.Next()
+				l.Emit(TokenCharO)
+				atomic.AddInt32(&sent, 1)
+			}
+			return nil
+		}
+
+		l := NewWithBuffer("test", "oo", pairStateFn, 0)
+		l.RunContext(ctx)
+		<-l.Tokens
+		cancel()
+
+		// the consumer stops reading, so the second send only returns if
+		// the lexer sees the cancellation while blocked
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&sent) < 2 {
+			if time.Now().After(deadline) {
+				l.Drain()
+				t.Fatal("Expected the lexer to stop sending once cancelled")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if _, ok := <-l.Tokens; ok {
+			t.Error("Expected no tokens after cancelling")
+		}
+	})
+}
+
+func TestTokenString(t *testing.T) {
+	const tokenNamed TokenType = 100
+	RegisterTokenName(tokenNamed, "TokenNamed")
+
+	if s := (Token{Typ: tokenNamed, Val: "{{"}).String(); s != `TokenNamed("{{")` {
+		t.Errorf("Expected named token string, got %s", s)
+	}
+	if s := (Token{Typ: TokenText, Val: "{{"}).String(); s != "{{" {
+		t.Errorf("Expected unnamed token to print its value, got %s", s)
+	}
+
+	for tt, expected := range map[TokenType]string{
+		tokenNamed: "TokenNamed",
+		TokenEOF:   "TokenEOF",
+		TokenError: "TokenError",
+		101:        "TokenType(101)",
+	} {
+		if s := tt.String(); s != expected {
+			t.Errorf("Expected %s, got %s", expected, s)
+		}
+	}
+}
+
+func TestPeekN(t *testing.T) {
+	l := New("test", "<!é", nil)
+	l.Next()
+	width := l.Width
+
+	if got := string(l.PeekN(2)); got != "!é" {
+		t.Errorf("Expected %q, got %q", "!é", got)
+	}
+	if got := string(l.PeekN(5)); got != "!é" {
+		t.Errorf("Expected peek to stop at EOF, got %q", got)
+	}
+	if l.Current != 1 || l.Width != width {
+		t.Errorf("Expected cursor to be untouched, got current %d width %d", l.Current, l.Width)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	t.Run("Repeated Backup does not move past the last rune read", func(t *testing.T) {
+		l := New("test", "aé", nil)
+		l.Next()
+		l.Next()
+		l.Backup()
+		l.Backup()
+		if l.Current != 1 {
+			t.Errorf("Expected cursor at 1, got %d", l.Current)
+		}
+	})
+
+	t.Run("BackupN steps back over multi-byte runes", func(t *testing.T) {
+		l := New("test", "xaéb", nil)
+		l.Next()
+		l.Ignore()
+		l.Next()
+		l.Next()
+		l.Next()
+
+		l.BackupN(2)
+		if l.Current != 2 || l.Width != 0 {
+			t.Errorf("Expected cursor at 2 with width 0, got %d width %d", l.Current, l.Width)
+		}
+		if r := l.Next(); r != 'é' {
+			t.Errorf("Expected to read 'é' again, got %q", r)
+		}
+
+		l.BackupN(10)
+		if l.Current != l.Start {
+			t.Errorf("Expected BackupN to stop at start %d, got %d", l.Start, l.Current)
+		}
+	})
+}
+
+func TestPending(t *testing.T) {
+	l := New("test", "if x", nil)
+	l.AcceptWhile(IsAlpha)
+	if p := l.Pending(); p != "if" {
+		t.Errorf("Expected pending text %q, got %q", "if", p)
+	}
+	if r := l.Remaining(); r != " x" {
+		t.Errorf("Expected remaining input %q, got %q", " x", r)
+	}
+}
+
+func TestEmitValue(t *testing.T) {
+	l := New("test", `"a\"b" c`, func(l *Lexer) StateFn {
+		l.Current += len(`"a\"b"`)
+		l.EmitValue(TokenText, `a"b`)
+		return nil
+	})
+
+	tok, _ := l.NextToken()
+	if tok.Val != `a"b` || tok.Start != 0 || tok.End != 6 {
+		t.Errorf("Expected %q over [0:6], got %q over [%d:%d]", `a"b`, tok.Val, tok.Start, tok.End)
+	}
+	if l.Start != l.Current {
+		t.Errorf("Expected start to move to current, got %d and %d", l.Start, l.Current)
+	}
+}
+
+func TestStateStack(t *testing.T) {
+	// Lexes nested parentheses, emitting each one as an open or close block.
+	// An unbalanced close pops an empty stack and ends the scan early.
+	var parenStateFn StateFn
+	parenStateFn = func(l *Lexer) StateFn {
+		switch l.Next() {
+		case '(':
+			l.Emit(TokenOpenBlock)
+			l.PushState(parenStateFn)
+			return parenStateFn
+		case ')':
+			l.Emit(TokenCloseBlock)
+			return l.PopState()
+		case EOF:
+			l.Emit(TokenEOF)
+			return nil
+		}
+		return l.Errorf("unexpected input")
+	}
+
+	var received []TokenType
+	for _, tok := range New("test", "(())", parenStateFn).AllTokens() {
+		received = append(received, tok.Typ)
+	}
+
+	expected := []TokenType{TokenOpenBlock, TokenOpenBlock, TokenCloseBlock, TokenCloseBlock, TokenEOF}
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, received)
+		}
+	}
+}
+
+func TestStatePanic(t *testing.T) {
+	panicStateFn := func(l *Lexer) StateFn {
+		var blocks []string
+		return l.Errorf("unreachable %s", blocks[l.Current])
+	}
+
+	t.Run("Run converts a panic into an error token", func(t *testing.T) {
+		l := New("test", "{", panicStateFn)
+		l.RunAsync()
+
+		tok := <-l.Tokens
+		if tok.Typ != TokenError || !strings.Contains(tok.Val, "panic") {
+			t.Errorf("Expected panic error token, got %v", tok)
+		}
+		if _, ok := <-l.Tokens; ok {
+			t.Error("Expected the channel to be closed after the panic")
+		}
+	})
+
+	t.Run("NextToken converts a panic into an error token", func(t *testing.T) {
+		l := New("test", "{", panicStateFn)
+
+		tok, _ := l.NextToken()
+		if tok.Typ != TokenError {
+			t.Errorf("Expected panic error token, got %v", tok)
+		}
+		if _, done := l.NextToken(); !done {
+			t.Error("Expected the scan to end after the panic")
+		}
+	})
+}
+
+func TestEmitBounds(t *testing.T) {
+	t.Run("Start past current emits an error", func(t *testing.T) {
+		l := New("test", "abc", func(l *Lexer) StateFn {
+			l.Start = 2
+			l.Current = 1
+			l.Emit(TokenText)
+			return nil
+		})
+
+		tok, _ := l.NextToken()
+		if tok.Typ != TokenError {
+			t.Errorf("Expected error token, got %v", tok)
+		}
+	})
+
+	t.Run("Advancing past the input is truncated", func(t *testing.T) {
+		l := New("test", "{", mockOpenBlockStateFn)
+
+		tok, _ := l.NextToken()
+		if tok.Typ != TokenOpenBlock || tok.Val != "{" || tok.End != 1 {
+			t.Errorf("Expected truncated open block, got %v over [%d:%d]", tok, tok.Start, tok.End)
+		}
+	})
+}
+
+func TestAcceptString(t *testing.T) {
+	l := New("test", "«{{»", nil)
+
+	if l.AcceptString("{{") {
+		t.Error("Expected no match at the start of input")
+	}
+	if !l.AcceptString("«{{") || l.Current != len("«{{") {
+		t.Errorf("Expected to consume %q, cursor at %d", "«{{", l.Current)
+	}
+}
+
+func TestNextHasPrefixFold(t *testing.T) {
+	l := New("test", "<DiV>", nil)
+
+	for prefix, expected := range map[string]bool{
+		"<div":   true,
+		"<DIV>":  true,
+		"<span":  false,
+		"<div>x": false,
+	} {
+		if got := l.NextHasPrefixFold(prefix); got != expected {
+			t.Errorf("NextHasPrefixFold(%q): expected %v, got %v", prefix, expected, got)
+		}
+	}
+}
+
+func TestNewWithBuffer(t *testing.T) {
+	l := NewWithBuffer("test", testString, mockTextStateFn, 8)
+	tokens := l.Tokens
+	l.RunAsync()
+
+	if l.Tokens != tokens || cap(l.Tokens) != 8 {
+		t.Errorf("Expected RunAsync to keep the constructor's channel with capacity 8, got capacity %d", cap(l.Tokens))
+	}
+	var out string
+	for tok := range tokens {
+		out += tok.String()
+	}
+	if out != testString+"EOF" {
+		t.Errorf("Expected %q, got %q", testString+"EOF", out)
+	}
+}
+
+func TestRunSyncChannel(t *testing.T) {
+	// One token per rune would overflow a channel sized from the input
+	l := New("test", "ooooo", mockTextStateFn)
+	tokens := l.Tokens
+	l.RunSync()
+
+	if l.Tokens != tokens {
+		t.Error("Expected RunSync to keep the constructor's channel")
+	}
+	if tok, ok := <-l.Tokens; ok {
+		t.Errorf("Expected the channel to be closed empty, got %v", tok)
+	}
+	var received []Token
+	for {
+		tok, done := l.Listen()
+		if done {
+			break
+		}
+		received = append(received, tok)
+	}
+	if len(received) != 5 {
+		t.Errorf("Expected 5 tokens, got %d", len(received))
+	}
+}
+
+func TestScanNumber(t *testing.T) {
+	for input, expected := range map[string]string{
+		"42":       "42",
+		"-3.14":    "-3.14",
+		"+1e10":    "+1e10",
+		"6.02E-23": "6.02E-23",
+		".5":       ".5",
+		"1.":       "1",
+		"1.x":      "1",
+		"2e":       "2",
+		"7e+x":     "7",
+		".":        "",
+		"-":        "",
+		"abc":      "",
+	} {
+		l := New("test", input, nil)
+		ok := l.ScanNumber()
+		if got := l.Pending(); got != expected || ok != (expected != "") {
+			t.Errorf("ScanNumber(%q): expected %q, got %q (ok=%v)", input, expected, got, ok)
+		}
+	}
+}
+
+func TestScanQuotedString(t *testing.T) {
+	t.Run("Decodes escapes", func(t *testing.T) {
+		l := New("test", `"a\"b\\c\nd" rest`, nil)
+		val, err := l.ScanQuotedString('"')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != "a\"b\\c\nd" {
+			t.Errorf("Expected decoded value, got %q", val)
+		}
+		if l.Pending() != `"a\"b\\c\nd"` {
+			t.Errorf("Expected the literal to be pending, got %q", l.Pending())
+		}
+	})
+
+	t.Run("Supports other quote runes", func(t *testing.T) {
+		l := New("test", `'it\'s'`, nil)
+		if val, err := l.ScanQuotedString('\''); err != nil || val != "it's" {
+			t.Errorf("Expected %q, got %q (%v)", "it's", val, err)
+		}
+	})
+
+	for _, input := range []string{`"abc`, `"abc\`, `"a\qb"`, `abc"`} {
+		l := New("test", input, nil)
+		if _, err := l.ScanQuotedString('"'); err == nil {
+			t.Errorf("ScanQuotedString(%q): expected an error", input)
+		}
+	}
+}
+
+func TestSkipSpaces(t *testing.T) {
+	l := New("test", " \t\n  name", nil)
+	l.SkipSpaces()
+
+	if l.Start != l.Current || l.Peek() != 'n' {
+		t.Errorf("Expected to skip to %q, got start %d current %d", "name", l.Start, l.Current)
+	}
+}
+
+func TestPeekIs(t *testing.T) {
+	l := New("test", "7", nil)
+	if !l.PeekIs(IsDigit) || l.PeekIs(IsAlpha) {
+		t.Error("Expected next rune to be a digit")
+	}
+	l.Next()
+	if l.PeekIs(func(rune) bool { return true }) {
+		t.Error("Expected PeekIs to be false at EOF")
+	}
+}
+
+func TestEmitMarker(t *testing.T) {
+	l := New("test", "ab", func(l *Lexer) StateFn {
+		l.Next()
+		l.EmitMarker(TokenCharO)
+		l.Next()
+		l.Emit(TokenText)
+		return nil
+	})
+
+	marker, _ := l.NextToken()
+	text, _ := l.NextToken()
+	if marker.Typ != TokenCharO || marker.Val != "" || marker.Start != 1 || marker.End != 1 {
+		t.Errorf("Expected empty marker at offset 1, got %v over [%d:%d]", marker, marker.Start, marker.End)
+	}
+	if text.Val != "ab" {
+		t.Errorf("Expected marker not to consume input, got text %q", text.Val)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	l := New("test", "oooooooooo", mockTextStateFn)
+	l.RunAsync()
+
+	if tok, _ := l.Listen(); tok.Typ != TokenCharO {
+		t.Fatalf("Expected first token to be a char o, got %v", tok)
+	}
+	l.Drain()
+	if _, ok := <-l.Tokens; ok {
+		t.Error("Expected the channel to be closed after Drain")
+	}
+}
+
+func TestExpectRune(t *testing.T) {
+	closeParenStateFn := func(l *Lexer) StateFn {
+		if s := l.ExpectRune(')'); s != nil {
+			return s
+		}
+		l.Emit(TokenCloseBlock)
+		return nil
+	}
+
+	for input, expected := range map[string]string{
+		")": ")",
+		"]": `test:1:1: unexpected ']', expected ')'`,
+		"":  `test:1:1: unexpected end of input, expected ')'`,
+	} {
+		tok, _ := New("test", input, closeParenStateFn).NextToken()
+		if tok.Val != expected {
+			t.Errorf("ExpectRune on %q: expected %q, got %q", input, expected, tok.Val)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	l := New("test", "0x1fz", nil)
+
+	if !l.Accept("0") || !l.Accept("xX") || l.Accept("xX") {
+		t.Fatalf("Expected to accept the hex prefix only, cursor at %d", l.Current)
+	}
+	l.AcceptRun("0123456789abcdef")
+	if l.Pending() != "0x1f" || l.Peek() != 'z' {
+		t.Errorf("Expected to accept %q, got %q", "0x1f", l.Pending())
+	}
+}
+
+func TestLineText(t *testing.T) {
+	l := New("test", "first\r\nsécond line\nlast", nil)
+
+	for offset, expected := range map[int]struct {
+		line string
+		col  int
+	}{
+		0:  {"first", 1},
+		10: {"sécond line", 3},
+		19: {"sécond line", 12},
+		23: {"last", 4},
+	} {
+		line, col := l.LineText(offset)
+		if line != expected.line || col != expected.col {
+			t.Errorf("LineText(%d): expected %q col %d, got %q col %d", offset, expected.line, expected.col, line, col)
+		}
+	}
+}
+
+func TestTokenStream(t *testing.T) {
+	t.Run("Reads tokens until EOF", func(t *testing.T) {
+		s := New("test", testString, mockTextStateFn).Stream()
+
+		var out string
+		for tok, ok := s.Next(); ok; tok, ok = s.Next() {
+			out += tok.String()
+		}
+		if out != testString || s.Err() != nil {
+			t.Errorf("Expected %q with no error, got %q (%v)", testString, out, s.Err())
+		}
+	})
+
+	t.Run("Reports an error token", func(t *testing.T) {
+		s := New("test", "", func(l *Lexer) StateFn {
+			return l.Errorf("bad input")
+		}).Stream()
+
+		if tok, ok := s.Next(); ok || tok.Typ != TokenError {
+			t.Errorf("Expected the stream to end with an error, got %v", tok)
+		}
+		if s.Err() == nil || s.Err().Error() != "test:1:1: bad input" {
+			t.Errorf("Expected error %q, got %v", "test:1:1: bad input", s.Err())
+		}
+		if _, ok := s.Next(); ok {
+			t.Error("Expected the stream to stay finished")
+		}
+	})
+}
+
+func TestRewind(t *testing.T) {
+	l := New("test", "1.5x", nil)
+	mark := l.Mark()
+
+	l.AcceptRun("0123456789.")
+	if l.Peek() != 'x' {
+		t.Fatalf("Expected to scan up to x, got %q", l.Pending())
+	}
+	l.Rewind(mark)
+	if l.Current != 0 || l.Width != 0 {
+		t.Errorf("Expected cursor back at 0, got current %d width %d", l.Current, l.Width)
+	}
+
+	l = New("test", "ab+cd", nil)
+	l.Next()
+	l.Ignore()
+	l.Next()
+	mark = l.Mark()
+	l.AcceptRun("+cd")
+	l.Emit(TokenText)
+	l.Rewind(mark)
+	if l.Start != 1 || l.Current != 2 || l.Width != 1 {
+		t.Errorf("Expected start 1, current 2 and width 1 restored, got %d, %d and %d", l.Start, l.Current, l.Width)
+	}
+	<-l.Tokens
+
+	for _, bad := range []int{-1, len(l.Input) + 1} {
+		l.Rewind(bad)
+		if tok := <-l.Tokens; tok.Typ != TokenError {
+			t.Errorf("Expected an error for mark %d, got %v", bad, tok)
+		}
+		if l.Current != 2 {
+			t.Errorf("Expected the cursor to stay put for mark %d, current %d", bad, l.Current)
+		}
+	}
+}
+
+func TestEmitPending(t *testing.T) {
+	l := New("test", "ab", func(l *Lexer) StateFn {
+		if l.EmitPending(TokenText) {
+			t.Error("Expected nothing to emit before scanning")
+		}
+		l.AcceptWhile(IsAlpha)
+		if !l.EmitPending(TokenText) {
+			t.Error("Expected the scanned text to be emitted")
+		}
+		return nil
+	})
+
+	if tok, _ := l.NextToken(); tok.Val != "ab" {
+		t.Errorf("Expected %q, got %q", "ab", tok.Val)
+	}
+}
+
+func TestStrictUTF8(t *testing.T) {
+	input := "ab\xffcd"
+
+	l := New("test", input, mockTextStateFn)
+	if tokens := l.AllTokens(); tokens[0].Val != input {
+		t.Errorf("Expected invalid UTF-8 to pass through by default, got %v", tokens)
+	}
+
+	l = New("test", input, mockTextStateFn)
+	l.SetStrictUTF8(true)
+	tokens := l.AllTokens()
+	if len(tokens) != 1 || tokens[0].Typ != TokenError {
+		t.Fatalf("Expected a single error token, got %v", tokens)
+	}
+	if !strings.Contains(tokens[0].Val, "offset 2") {
+		t.Errorf("Expected the error to give the offset, got %q", tokens[0].Val)
+	}
+}
+
+func TestNumEmitted(t *testing.T) {
+	l := New("test", testString, mockTextStateFn)
+	l.RunAsync()
+
+	received := 0
+	for range l.Tokens {
+		received++
+		if n := l.NumEmitted(); n < received {
+			t.Errorf("Expected at least %d tokens emitted, got %d", received, n)
+		}
+	}
+	if n := l.NumEmitted(); n != 6 {
+		t.Errorf("Expected 6 tokens emitted, got %d", n)
+	}
+	if n := l.BytesConsumed(); n != len(testString) {
+		t.Errorf("Expected %d bytes consumed, got %d", len(testString), n)
+	}
+}
+
+func TestDecodeRune(t *testing.T) {
+	// Latin-1 maps every byte directly to the code point of the same value
+	latin1 := func(s string) (rune, int) {
+		return rune(s[0]), 1
+	}
+
+	l := New("test", "caf\xe9!", nil)
+	l.DecodeRune = latin1
+
+	if n := l.AcceptWhile(IsAlpha); n != 4 {
+		t.Errorf("Expected 4 letters, got %d", n)
+	}
+	if r := l.Next(); r != '!' {
+		t.Errorf("Expected '!', got %q", r)
+	}
+	l.BackupN(2)
+	if r := l.Next(); r != 'é' {
+		t.Errorf("Expected 'é' after backing up, got %q", r)
+	}
+}
+
+func TestClone(t *testing.T) {
+	l := New("test", testString, mockTextStateFn)
+	first, _ := l.NextToken()
+
+	c := l.Clone()
+	if c.Tokens == l.Tokens {
+		t.Fatal("Expected the clone to have its own channel")
+	}
+
+	orig, cloned := l.AllTokens(), c.AllTokens()
+	if len(orig) != len(cloned) {
+		t.Fatalf("Expected clone to produce the same tokens, got %v and %v", orig, cloned)
+	}
+	for i := range orig {
+		if orig[i] != cloned[i] {
+			t.Errorf("token %d: expected %v, got %v", i, orig[i], cloned[i])
+		}
+	}
+	if first.Val != "<div>" || orig[0].Val != "{{" {
+		t.Errorf("Expected the clone to continue after %q, got %v", first.Val, orig)
+	}
+}
+
+func TestTriviaHandler(t *testing.T) {
+	l := New("test", "a  b", nil)
+	var spans [][2]int
+	l.SetTriviaHandler(func(start, end int) {
+		spans = append(spans, [2]int{start, end})
+	})
+
+	l.Next()
+	l.Emit(TokenText)
+	l.SkipSpaces()
+	l.SkipSpaces()
+
+	if len(spans) != 1 || spans[0] != [2]int{1, 3} {
+		t.Errorf("Expected a single trivia span [1 3], got %v", spans)
+	}
+}
+
+func TestTokenJSON(t *testing.T) {
+	const tokenJSONNamed TokenType = 102
+	RegisterTokenName(tokenJSONNamed, "TokenJSONNamed")
+
+	tokens := []Token{
+		{Typ: tokenJSONNamed, Val: "<div>", Line: 1, Column: 1, Start: 0, End: 5},
+		{Typ: TokenText, Val: "x", Line: 2, Column: 3, Start: 8, End: 9},
+		{Typ: TokenEOF, Line: 2, Column: 4, Start: 9, End: 9},
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(tokens); err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"type":"TokenJSONNamed","value":"<div>","line":1,"column":1,"start":0,"end":5},` +
+		`{"type":0,"value":"x","line":2,"column":3,"start":8,"end":9},` +
+		`{"type":"TokenEOF","value":"","line":2,"column":4,"start":9,"end":9}]` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buf.String())
+	}
+
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []Token
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(tokens) {
+		t.Fatalf("Expected %d tokens, got %d", len(tokens), len(decoded))
+	}
+	for i := range tokens {
+		if decoded[i] != tokens[i] {
+			t.Errorf("token %d: expected %v, got %v", i, tokens[i], decoded[i])
+		}
+	}
+
+	synthetic := NewToken(tokenJSONNamed, ";", 3, 7)
+	data, err = json.Marshal(synthetic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tok Token
+	if err := json.Unmarshal(data, &tok); err != nil {
+		t.Fatal(err)
+	}
+	if tok != synthetic || tok.Line != 3 || tok.Column != 7 {
+		t.Errorf("Expected %#v, got %#v", synthetic, tok)
+	}
+
+	if err := json.Unmarshal([]byte(`{"type":"TokenUnknown"}`), &tok); err == nil {
+		t.Error("Expected an error for an unregistered type name")
+	}
+}
+
+func TestTokenEqual(t *testing.T) {
+	a := Token{Typ: TokenText, Val: "x", Line: 1, Column: 1, Start: 0, End: 1}
+	b := Token{Typ: TokenText, Val: "x", Line: 3, Column: 2, Start: 9, End: 10}
+
+	if !a.Equal(b) || a.EqualPos(b) || !a.EqualPos(a) {
+		t.Error("Expected Equal to ignore positions and EqualPos to compare them")
+	}
+	if a.Equal(Token{Typ: TokenCharO, Val: "x"}) {
+		t.Error("Expected tokens of different types not to be equal")
+	}
+	if !TokensEqual([]Token{a}, []Token{b}) || TokensEqual([]Token{a}, []Token{a, b}) {
+		t.Error("Expected TokensEqual to compare slices element-wise")
+	}
+}
+
+func TestEmitAll(t *testing.T) {
+	// Splits "+=" into separate tokens, more than the default channel holds
+	l := New("test", "+=", func(l *Lexer) StateFn {
+		l.Current = len(l.Input)
+		l.EmitAll([]Token{
+			{Typ: TokenText, Val: "+", Start: 0, End: 1},
+			{Typ: TokenText, Val: "=", Start: 1, End: 2},
+			{Typ: TokenNewLine, Start: 2, End: 2},
+			{Typ: TokenEOF, Start: 2, End: 2},
+		})
+		return nil
+	})
+
+	tokens := l.AllTokens()
+	expected := []Token{{Typ: TokenText, Val: "+"}, {Typ: TokenText, Val: "="}, {Typ: TokenNewLine}, {Typ: TokenEOF}}
+	if !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+	if l.Start != l.Current {
+		t.Errorf("Expected start to move to current, got %d and %d", l.Start, l.Current)
+	}
+}
+
+func TestMaxTokenBytes(t *testing.T) {
+	l := New("test", "{{unterminated block", mockTextStateFn)
+	l.SetMaxTokenBytes(8)
+
+	tokens := l.AllTokens()
+	if len(tokens) != 2 || tokens[0].Typ != TokenOpenBlock || tokens[1].Typ != TokenError {
+		t.Fatalf("Expected an open block and an error, got %v", tokens)
+	}
+	if !strings.Contains(tokens[1].Val, "exceeds the maximum of 8") {
+		t.Errorf("Unexpected error message %q", tokens[1].Val)
+	}
+}
+
+func TestAcceptUntilOrError(t *testing.T) {
+	blockStateFn := func(l *Lexer) StateFn {
+		l.AcceptString(openBlock)
+		if s := l.AcceptUntilOrError(closeBlock, "block"); s != nil {
+			return s
+		}
+		l.AcceptString(closeBlock)
+		l.Emit(TokenOpenBlock)
+		return nil
+	}
+
+	if tok, _ := New("test", "{{name}}", blockStateFn).NextToken(); tok.Val != "{{name}}" {
+		t.Errorf("Expected the whole block, got %v", tok)
+	}
+	if tok, _ := New("test", "{{name", blockStateFn).NextToken(); tok.Val != "test:1:7: unterminated block" {
+		t.Errorf("Expected an unterminated block error, got %v", tok)
+	}
+}
+
+func TestFinalState(t *testing.T) {
+	runs := 0
+	textStateFn := func(l *Lexer) StateFn {
+		l.AcceptUntil("\x00")
+		l.EmitPending(TokenText)
+		return nil
+	}
+	finalStateFn := func(l *Lexer) StateFn {
+		runs++
+		l.Emit(TokenEOF)
+		return nil
+	}
+
+	l := New("test", "text", textStateFn)
+	l.FinalState = finalStateFn
+	tokens := l.AllTokens()
+	if !TokensEqual(tokens, []Token{{Typ: TokenText, Val: "text"}, {Typ: TokenEOF}}) {
+		t.Errorf("Expected text then EOF, got %v", tokens)
+	}
+
+	l = New("test", "text", textStateFn)
+	l.FinalState = finalStateFn
+	l.RunSync()
+	for {
+		if _, done := l.Listen(); done {
+			break
+		}
+	}
+	if runs != 2 {
+		t.Errorf("Expected the final state to run once per scan, ran %d times", runs)
+	}
+
+	errorStateFn := func(l *Lexer) StateFn {
+		return l.Errorf("bad input")
+	}
+	l = New("test", "text", errorStateFn)
+	l.FinalState = finalStateFn
+	tokens = l.AllTokens()
+	if len(tokens) != 1 || tokens[0].Typ != TokenError {
+		t.Errorf("Expected the scan to end with the error, got %v", tokens)
+	}
+
+	l = New("test", "text", errorStateFn)
+	l.FinalState = finalStateFn
+	l.RunConc()
+	tokens = nil
+	for tok := range l.Tokens {
+		tokens = append(tokens, tok)
+	}
+	if len(tokens) != 1 || tokens[0].Typ != TokenError {
+		t.Errorf("Expected no tokens on the channel after the error, got %v", tokens)
+	}
+	if runs != 2 {
+		t.Errorf("Expected the final state to be skipped after an error, ran %d times", runs)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	l := New("test", "text{{", mockTextStateFn)
+	first := l.AllTokens()
+
+	l.Restart()
+	if l.Start != 0 || l.Current != 0 || l.Width != 0 {
+		t.Fatalf("Expected the cursor at 0, got start %d current %d width %d", l.Start, l.Current, l.Width)
+	}
+	if second := l.AllTokens(); !TokensEqual(first, second) {
+		t.Errorf("Expected %v after restart, got %v", first, second)
+	}
+
+	l.Restart()
+	l.RunConc()
+	var tokens []Token
+	for tok := range l.Tokens {
+		tokens = append(tokens, tok)
+	}
+	if !TokensEqual(first, tokens) {
+		t.Errorf("Expected %v from a restarted RunConc, got %v", first, tokens)
+	}
+}
+
+func TestSetEmitValues(t *testing.T) {
+	l := New("test", "secret{{", mockTextStateFn)
+	l.SetEmitValues(false)
+	tokens := l.AllTokens()
+
+	expected := []Token{
+		{Typ: TokenText, Line: 1, Column: 1, Start: 0, End: 6},
+		{Typ: TokenOpenBlock, Line: 1, Column: 7, Start: 6, End: 8},
+	}
+	if len(tokens) < len(expected) {
+		t.Fatalf("Expected at least %d tokens, got %v", len(expected), tokens)
+	}
+	for i, want := range expected {
+		if !tokens[i].EqualPos(want) {
+			t.Errorf("Expected %#v, got %#v", want, tokens[i])
+		}
+	}
+}
+
+func TestScanIdentifier(t *testing.T) {
+	tests := []struct {
+		input, ident string
+	}{
+		{"foo bar", "foo"},
+		{"_x1+", "_x1"},
+		{"ünïcode9", "ünïcode9"},
+		{"9lives", ""},
+		{"+", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		l := New("test", tt.input, nil)
+		if got := l.ScanIdentifier(); got != tt.ident {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.ident, got)
+		}
+		if l.Current != len(tt.ident) {
+			t.Errorf("%q: expected to consume %d bytes, consumed %d", tt.input, len(tt.ident), l.Current)
+		}
+	}
+}
+
+func TestRunSyncE(t *testing.T) {
+	tokens, err := New("test", "text{{", mockTextStateFn).RunSyncE()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if last := tokens[len(tokens)-1]; last.Typ != TokenEOF {
+		t.Errorf("Expected the tokens to end with EOF, got %v", tokens)
+	}
+
+	tokens, err = New("test", "ab\ncd", func(l *Lexer) StateFn {
+		l.AcceptUntil("\n")
+		l.Emit(TokenText)
+		return l.Errorf("bad input")
+	}).RunSyncE()
+	if err == nil || err.Error() != "test:1:3: bad input" {
+		t.Errorf("Expected the error message, got %v", err)
+	}
+	if !TokensEqual(tokens, []Token{{Typ: TokenText, Val: "ab"}}) {
+		t.Errorf("Expected the tokens before the error, got %v", tokens)
+	}
+}
+
+func TestNewBytes(t *testing.T) {
+	input := []byte("text{{")
+	got := NewBytes("test", input, mockTextStateFn).AllTokens()
+	expected := New("test", string(input), mockTextStateFn).AllTokens()
+	if !TokensEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if got[0].Val != "text" {
+		t.Errorf("Expected the first token to be \"text\", got %q", got[0].Val)
+	}
+
+	if tokens := NewBytes("test", nil, mockTextStateFn).AllTokens(); tokens[len(tokens)-1].Typ != TokenEOF {
+		t.Errorf("Expected a nil slice to lex as empty input, got %v", tokens)
+	}
+}
+
+func TestPeekRune(t *testing.T) {
+	l := New("test", "«a", nil)
+	l.Width = 5
+	r, width := l.PeekRune()
+	if r != '«' || width != 2 {
+		t.Errorf("Expected '«' of width 2, got %q of width %d", r, width)
+	}
+	if l.Current != 0 || l.Width != 5 {
+		t.Errorf("Expected PeekRune not to change the lexer, got current %d width %d", l.Current, l.Width)
+	}
+
+	l.Current += width
+	if r, width = l.PeekRune(); r != 'a' || width != 1 {
+		t.Errorf("Expected 'a' of width 1, got %q of width %d", r, width)
+	}
+	l.Current += width
+	if r, width = l.PeekRune(); r != EOF || width != 0 {
+		t.Errorf("Expected EOF of width 0, got %q of width %d", r, width)
+	}
+}
+
+func TestTryListen(t *testing.T) {
+	l := New("test", "text", mockTextStateFn)
+	if _, _, available := l.TryListen(); available {
+		t.Error("Expected no token before the lexer has run")
+	}
+
+	l.RunSync()
+	var tokens []Token
+	for {
+		tok, done, available := l.TryListen()
+		if !available {
+			t.Fatal("Expected a token to be available after RunSync")
+		}
+		tokens = append(tokens, tok)
+		if done {
+			break
+		}
+	}
+	if last := tokens[len(tokens)-1]; last.Typ != TokenEOF {
+		t.Errorf("Expected the tokens to end with EOF, got %v", tokens)
+	}
+	if tok, done, available := l.TryListen(); !available || !done || tok.Typ != TokenEOF {
+		t.Errorf("Expected EOF once the channel is closed, got %v %v %v", tok, done, available)
+	}
+}
+
+func TestListenClosed(t *testing.T) {
+	l := New("test", "text", func(l *Lexer) StateFn {
+		l.AcceptUntil("\x00")
+		l.Emit(TokenText)
+		return nil
+	})
+	l.RunConc()
+	if tok, done := l.Listen(); done || tok.Val != "text" {
+		t.Fatalf("Expected the text token, got %v %v", tok, done)
+	}
+	if tok, done := l.Listen(); !done || tok.Typ != TokenEOF {
+		t.Errorf("Expected a closed channel to report EOF, got %v %v", tok, done)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	s := New("test", "a{{b}}c", mockTextStateFn).Filter(TokenOpenBlock, TokenCloseBlock, TokenEOF)
+
+	var out string
+	tok, ok := s.Next()
+	for ; ok; tok, ok = s.Next() {
+		out += tok.String()
+	}
+	if out != "abc" {
+		t.Errorf("Expected the block tokens to be dropped, got %q", out)
+	}
+	if tok.Typ != TokenEOF || s.Err() != nil {
+		t.Errorf("Expected the stream to still end with EOF, got %v (%v)", tok, s.Err())
+	}
+}
+
+func TestAcceptRune(t *testing.T) {
+	l := New("test", "(é", nil)
+	if !l.AcceptRune('(') || l.Current != 1 {
+		t.Errorf("Expected '(' to be accepted, current %d", l.Current)
+	}
+	if l.AcceptRune(')') || l.Current != 1 {
+		t.Errorf("Expected ')' not to be accepted, current %d", l.Current)
+	}
+	if !l.AcceptRune('é') || l.Current != 3 {
+		t.Errorf("Expected 'é' to be accepted, current %d", l.Current)
+	}
+	if l.AcceptRune('x') || l.Current != 3 {
+		t.Errorf("Expected nothing to be accepted at the end, current %d", l.Current)
+	}
+}
+
+func TestEmitThen(t *testing.T) {
+	var blockStateFn StateFn
+	textStateFn := func(l *Lexer) StateFn {
+		if l.AcceptUntil(openBlock) {
+			return l.EmitThen(TokenText, blockStateFn)
+		}
+		return l.EmitThen(TokenEOF, nil)
+	}
+	blockStateFn = func(l *Lexer) StateFn {
+		l.AcceptString(openBlock)
+		return l.EmitThen(TokenOpenBlock, textStateFn)
+	}
+
+	tokens := New("test", "a{{", textStateFn).AllTokens()
+	expected := []Token{{Typ: TokenText, Val: "a"}, {Typ: TokenOpenBlock, Val: "{{"}, {Typ: TokenEOF}}
+	if !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+}
+
+func TestPeekToken(t *testing.T) {
+	l := New("test", "a{{b", mockTextStateFn)
+
+	tok, done := l.PeekToken()
+	if done || !tok.Equal(Token{Typ: TokenText, Val: "a"}) {
+		t.Errorf("Expected to peek the text token, got %v", tok)
+	}
+	peeked := l.PeekTokenN(2)
+	if !TokensEqual(peeked, []Token{{Typ: TokenText, Val: "a"}, {Typ: TokenOpenBlock, Val: "{{"}}) {
+		t.Errorf("Expected to peek two tokens, got %v", peeked)
+	}
+	if next, _ := l.NextToken(); next != tok {
+		t.Errorf("Expected NextToken to return the peeked %v, got %v", tok, next)
+	}
+
+	rest := l.PeekTokenN(10)
+	if len(rest) != 3 || rest[len(rest)-1].Typ != TokenEOF {
+		t.Errorf("Expected the lookahead to stop at EOF, got %v", rest)
+	}
+	if tokens := l.AllTokens(); !TokensEqual(tokens, rest) {
+		t.Errorf("Expected the remaining tokens %v, got %v", rest, tokens)
+	}
+}
+
+func TestWhitespaceState(t *testing.T) {
+	var wordStateFn StateFn
+	wordStateFn = func(l *Lexer) StateFn {
+		if l.AcceptWhile(IsAlpha) == 0 {
+			return l.EmitThen(TokenEOF, nil)
+		}
+		return l.EmitThen(TokenText, WhitespaceState(wordStateFn))
+	}
+
+	tokens := New("test", "one \t\ntwo  three", wordStateFn).AllTokens()
+	expected := []Token{
+		{Typ: TokenText, Val: "one"},
+		{Typ: TokenText, Val: "two"},
+		{Typ: TokenText, Val: "three"},
+		{Typ: TokenEOF},
+	}
+	if !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+	if tokens[1].Start != 6 || tokens[2].Start != 12 {
+		t.Errorf("Expected the words at offsets 6 and 12, got %d and %d", tokens[1].Start, tokens[2].Start)
+	}
+}
+
+func TestScanDelimited(t *testing.T) {
+	tests := []struct {
+		input    string
+		depth    int
+		consumed int
+		err      string
+	}{
+		{"(a) b", 1, 3, ""},
+		{"((a) (b (c)))x", 3, 13, ""},
+		{"()", 1, 2, ""},
+		{"((a)", 2, 4, "unbalanced '(' starting at offset 0"},
+		{"a)", 0, 0, "expected '(' at offset 0"},
+	}
+	for _, tt := range tests {
+		l := New("test", tt.input, nil)
+		depth, err := l.ScanDelimited('(', ')')
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%q: expected error %q, got %v", tt.input, tt.err, err)
+		}
+		if depth != tt.depth || l.Current != tt.consumed {
+			t.Errorf("%q: expected depth %d and %d bytes consumed, got %d and %d", tt.input, tt.depth, tt.consumed, depth, l.Current)
+		}
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	f, err := os.ReadFile("./test/fixtures/plaintext")
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := string(f)
+	unicodeInput := strings.Repeat("héllo wörld ", len(input)/14)
+
+	b.Run("ASCII", func(b *testing.B) {
+		l := New("bench", input, nil)
+		b.SetBytes(int64(len(input)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			l.Current = 0
+			for l.Next() != EOF {
+			}
+		}
+	})
+
+	b.Run("UTF-8", func(b *testing.B) {
+		l := New("bench", unicodeInput, nil)
+		b.SetBytes(int64(len(l.Input)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			l.Current = 0
+			for l.Next() != EOF {
+			}
+		}
+	})
+}
+
+func TestSetBatchSize(t *testing.T) {
+	expected := New("test", testString, mockTextStateFn).AllTokens()
+
+	for _, size := range []int{1, 2, 3, 100} {
+		l := New("test", testString, mockTextStateFn)
+		l.SetBatchSize(size)
+		l.RunConc()
+
+		var tokens []Token
+		for {
+			tok, done := l.Listen()
+			tokens = append(tokens, tok)
+			if done {
+				break
+			}
+		}
+		if !TokensEqual(tokens, expected) {
+			t.Errorf("batch size %d: expected %v, got %v", size, expected, tokens)
+		}
+		if _, done := l.Listen(); !done {
+			t.Errorf("batch size %d: expected Listen to stay done", size)
+		}
+	}
+
+	l := New("test", "oooooooooo", mockTextStateFn)
+	l.SetBatchSize(4)
+	l.RunConc()
+	l.Listen()
+	l.Drain()
+	if _, ok := <-l.Tokens; ok {
+		t.Error("Expected the channel to be closed after Drain")
+	}
+}
+
+func BenchmarkRunConc(b *testing.B) {
+	f, err := os.ReadFile("./test/fixtures/plaintext")
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := string(f)
+
+	for _, size := range []int{1, 64} {
+		b.Run("batch="+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				l := New("bench", input, mockTextStateFn)
+				l.SetBatchSize(size)
+				l.RunConc()
+				for _, done := l.Listen(); !done; _, done = l.Listen() {
+				}
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	var tokens []Token
+	l := New("test", testString, mockTextStateFn)
+	l.Scan(func(tok Token) bool {
+		tokens = append(tokens, tok)
+		return true
+	})
+	if expected := New("test", testString, mockTextStateFn).AllTokens(); !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+
+	calls := 0
+	New("test", "oooooooooo", mockTextStateFn).Scan(func(tok Token) bool {
+		calls++
+		return calls < 3
+	})
+	if calls != 3 {
+		t.Errorf("Expected the scan to stop after 3 tokens, got %d", calls)
+	}
+}
+
+func TestLineIndex(t *testing.T) {
+	l := New("test", "ab\ncd\r\n\nef", nil)
+	index := l.LineIndex()
+	expected := []int{0, 3, 7, 8}
+	if len(index) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, index)
+	}
+	for i := range expected {
+		if index[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, index)
+			break
+		}
+	}
+
+	for offset := 0; offset <= len(l.Input); offset++ {
+		line := sort.SearchInts(index, offset+1)
+		if want, _ := l.position(offset); line != want {
+			t.Errorf("offset %d: expected line %d, got %d", offset, want, line)
+		}
+	}
+
+	l.Reset("one\ntwo\n")
+	if index := l.LineIndex(); len(index) != 3 || index[1] != 4 || index[2] != 8 {
+		t.Errorf("Expected the index to be rebuilt after Reset, got %v", index)
+	}
+}
+
+func TestPeekWord(t *testing.T) {
+	l := New("test", "return_1 x", nil)
+	l.Width = 3
+	if word := l.PeekWord(); word != "return_1" {
+		t.Errorf("Expected %q, got %q", "return_1", word)
+	}
+	if l.Current != 0 || l.Width != 3 {
+		t.Errorf("Expected PeekWord not to change the lexer, got current %d width %d", l.Current, l.Width)
+	}
+
+	l.Current = 8
+	if word := l.PeekWord(); word != "" {
+		t.Errorf("Expected no word before a space, got %q", word)
+	}
+	l.Current = len(l.Input)
+	if word := l.PeekWord(); word != "" {
+		t.Errorf("Expected no word at the end of input, got %q", word)
+	}
+}
+
+func TestSetNewlineNormalize(t *testing.T) {
+	textStateFn := func(l *Lexer) StateFn {
+		l.AcceptUntil("\x00")
+		return l.EmitThen(TokenText, nil)
+	}
+	l := New("test", "a\r\nb\nc\r", textStateFn)
+	l.SetNewlineNormalize(true)
+	tok, _ := l.NextToken()
+	if tok.Val != "a\nb\nc\r" || tok.Start != 0 || tok.End != 7 {
+		t.Errorf("Expected normalized newlines over the original span, got %#v", tok)
+	}
+	if l.Input != "a\r\nb\nc\r" {
+		t.Errorf("Expected the input to be untouched, got %q", l.Input)
+	}
+}
+
+func TestConsumeRunes(t *testing.T) {
+	l := New("test", "aé€b", nil)
+	if n := l.ConsumeRunes(3); n != 3 || l.Current != 6 {
+		t.Errorf("Expected 3 runes over 6 bytes, got %d runes and current %d", n, l.Current)
+	}
+	l.Backup()
+	if l.Current != 3 {
+		t.Errorf("Expected Backup to step over the last rune, current %d", l.Current)
+	}
+	if n := l.ConsumeRunes(5); n != 2 || l.Current != len(l.Input) {
+		t.Errorf("Expected 2 runes before the end, got %d and current %d", n, l.Current)
+	}
+}
+
+func TestEmitTrimmed(t *testing.T) {
+	l := New("test", "{{ name\t}}", nil)
+	l.AcceptString(openBlock)
+	l.Ignore()
+	l.AcceptUntil(closeBlock)
+	l.EmitTrimmed(TokenText)
+
+	tok := <-l.Tokens
+	if tok.Val != "name" || tok.Start != 2 || tok.End != 8 {
+		t.Errorf("Expected \"name\" over [2:8], got %#v", tok)
+	}
+	if l.Start != 8 {
+		t.Errorf("Expected start past the untrimmed text, got %d", l.Start)
+	}
+
+	l = New("test", " a\r\nb ", nil)
+	l.SetNewlineNormalize(true)
+	l.AcceptUntil("\x00")
+	l.EmitTrimmed(TokenText)
+	if tok := <-l.Tokens; tok.Val != "a\nb" {
+		t.Errorf("Expected normalized newlines in the trimmed value, got %q", tok.Val)
+	}
+}
+
+func TestCommentStates(t *testing.T) {
+	var codeStateFn StateFn
+	codeStateFn = func(l *Lexer) StateFn {
+		switch {
+		case l.NextHasPrefix("//"):
+			return LineCommentState("//", codeStateFn)
+		case l.NextHasPrefix("/*"):
+			return BlockCommentState("/*", "*/", codeStateFn)
+		case l.NextHasPrefix(newLine):
+			l.AcceptString(newLine)
+			return l.EmitThen(TokenNewLine, codeStateFn)
+		case l.AcceptWhile(IsAlpha) > 0:
+			return l.EmitThen(TokenText, codeStateFn)
+		}
+		return l.EmitThen(TokenEOF, nil)
+	}
+
+	tokens := New("test", "a// one\nb/* two\n*/c", codeStateFn).AllTokens()
+	expected := []Token{
+		{Typ: TokenText, Val: "a"},
+		{Typ: TokenNewLine, Val: "\n"},
+		{Typ: TokenText, Val: "b"},
+		{Typ: TokenText, Val: "c"},
+		{Typ: TokenEOF},
+	}
+	if !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+
+	tokens = New("test", "a/* two", codeStateFn).AllTokens()
+	if last := tokens[len(tokens)-1]; last.Typ != TokenError || last.Val != "test:1:8: unterminated block comment" {
+		t.Errorf("Expected an unterminated comment error, got %v", tokens)
+	}
+}
+
+func TestNewAt(t *testing.T) {
+	doc := "<script>a{{b}}</script>"
+	const base = 8
+	tokens := NewAt("test", doc[base:base+6], mockTextStateFn, base).AllTokens()
+
+	expected := []Token{
+		{Typ: TokenText, Val: "a", Line: 1, Column: 1, Start: 8, End: 9},
+		{Typ: TokenOpenBlock, Val: "{{", Line: 1, Column: 2, Start: 9, End: 11},
+		{Typ: TokenText, Val: "b", Line: 1, Column: 4, Start: 11, End: 12},
+		{Typ: TokenCloseBlock, Val: "}}", Line: 1, Column: 5, Start: 12, End: 14},
+		{Typ: TokenEOF, Line: 1, Column: 7, Start: 14, End: 14},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, tokens)
+	}
+	for i, tok := range tokens {
+		if !tok.EqualPos(expected[i]) {
+			t.Errorf("Expected %#v, got %#v", expected[i], tok)
+		}
+		if tok.Val != doc[tok.Start:tok.End] {
+			t.Errorf("Expected %q to map back into the document, got %q", tok.Val, doc[tok.Start:tok.End])
+		}
+	}
+}
+
+func TestLastToken(t *testing.T) {
+	l := New("test", "a{{", mockTextStateFn)
+	if _, ok := l.LastToken(); ok {
+		t.Error("Expected no last token before lexing")
+	}
+
+	l.NextToken()
+	if tok, ok := l.LastToken(); !ok || !tok.Equal(Token{Typ: TokenText, Val: "a"}) {
+		t.Errorf("Expected the text token, got %v", tok)
+	}
+	l.AllTokens()
+	if tok, ok := l.LastToken(); !ok || tok.Typ != TokenEOF {
+		t.Errorf("Expected EOF to be the last token, got %v", tok)
+	}
+
+	l.Reset("")
+	if _, ok := l.LastToken(); ok {
+		t.Error("Expected Reset to clear the last token")
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	// emits only when there is pending text, so never emits on empty input
+	textStateFn := func(l *Lexer) StateFn {
+		l.AcceptUntil("\x00")
+		l.EmitPending(TokenText)
+		return nil
+	}
+
+	t.Run("NextToken", func(t *testing.T) {
+		tokens := New("test", "", textStateFn).AllTokens()
+		if len(tokens) != 1 || !tokens[0].EqualPos(Token{Typ: TokenEOF, Line: 1, Column: 1}) {
+			t.Errorf("Expected a single EOF, got %#v", tokens)
+		}
+	})
+
+	t.Run("RunSync", func(t *testing.T) {
+		l := New("test", "", textStateFn)
+		l.RunSync()
+		if tok, done := l.Listen(); !done || tok.Typ != TokenEOF {
+			t.Errorf("Expected a single EOF, got %v", tok)
+		}
+		if l.NumEmitted() != 1 {
+			t.Errorf("Expected the EOF to be emitted, got %d tokens", l.NumEmitted())
+		}
+	})
+
+	t.Run("RunConc", func(t *testing.T) {
+		l := New("test", "", textStateFn)
+		l.RunConc()
+		var tokens []Token
+		for tok := range l.Tokens {
+			tokens = append(tokens, tok)
+		}
+		if len(tokens) != 1 || tokens[0].Typ != TokenEOF {
+			t.Errorf("Expected a single EOF on the channel, got %v", tokens)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		var tokens []Token
+		New("test", "", textStateFn).Scan(func(tok Token) bool {
+			tokens = append(tokens, tok)
+			return true
+		})
+		if len(tokens) != 1 || tokens[0].Typ != TokenEOF {
+			t.Errorf("Expected a single EOF from Scan, got %v", tokens)
+		}
+
+		tokens = nil
+		New("test", "ab", textStateFn).Scan(func(tok Token) bool {
+			tokens = append(tokens, tok)
+			return true
+		})
+		if !TokensEqual(tokens, []Token{{Typ: TokenText, Val: "ab"}, {Typ: TokenEOF}}) {
+			t.Errorf("Expected the text then EOF from Scan, got %v", tokens)
+		}
+	})
+
+	t.Run("Emitted EOF is not repeated", func(t *testing.T) {
+		l := New("test", "", mockTextStateFn)
+		l.RunConc()
+		var tokens []Token
+		for tok := range l.Tokens {
+			tokens = append(tokens, tok)
+		}
+		if len(tokens) != 1 || tokens[0].Typ != TokenEOF {
+			t.Errorf("Expected a single EOF on the channel, got %v", tokens)
+		}
+	})
+}
+
+func TestUnread(t *testing.T) {
+	l := New("test", "a{{b", mockTextStateFn)
+	first, _ := l.NextToken()
+	second, _ := l.NextToken()
+
+	l.Unread(second)
+	l.Unread(first)
+	if tok, _ := l.PeekToken(); tok != first {
+		t.Errorf("Expected to peek the unread %v, got %v", first, tok)
+	}
+	tokens := l.AllTokens()
+	expected := []Token{first, second, {Typ: TokenText, Val: "b"}, {Typ: TokenEOF}}
+	if !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+
+	l = New("test", "a", mockTextStateFn)
+	l.RunConc()
+	tok, _ := l.Listen()
+	l.Unread(tok)
+	if again, _ := l.Listen(); again != tok {
+		t.Errorf("Expected Listen to return the unread %v, got %v", tok, again)
+	}
+	l.Drain()
+}
+
+func TestSetTrace(t *testing.T) {
+	var buf bytes.Buffer
+	l := New("test", "a{{", mockTextStateFn)
+	l.SetTrace(&buf)
+	l.AllTokens()
+
+	expected := "test: state github.com/gmanninglive/golex.mockTextStateFn\n" +
+		"test:1:1: emit TokenType(0) \"a\" [0:1]\n" +
+		"test: state github.com/gmanninglive/golex.mockOpenBlockStateFn\n" +
+		"test:1:2: emit TokenType(1) \"{{\" [1:3]\n" +
+		"test: state github.com/gmanninglive/golex.mockTextStateFn\n" +
+		"test:1:4: emit TokenEOF \"\" [3:3]\n"
+	if buf.String() != expected {
+		t.Errorf("Expected trace:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestSkipBOMAndShebang(t *testing.T) {
+	l := New("test", "\uFEFF#!/bin/sh -e\r\necho", nil)
+	if !l.SkipBOM() || l.Start != 3 || l.Current != 3 {
+		t.Errorf("Expected the BOM to be skipped, start %d current %d", l.Start, l.Current)
+	}
+	if l.SkipBOM() {
+		t.Error("Expected no second BOM")
+	}
+	line, ok := l.ScanShebang()
+	if !ok || line != "#!/bin/sh -e" || l.Pending() != line {
+		t.Errorf("Expected the shebang line to be pending, got %q (%v), pending %q", line, ok, l.Pending())
+	}
+
+	l = New("test", "echo #!x", nil)
+	if l.SkipBOM() || l.Current != 0 {
+		t.Errorf("Expected no BOM, current %d", l.Current)
+	}
+	if _, ok := l.ScanShebang(); ok || l.Current != 0 {
+		t.Errorf("Expected no shebang, current %d", l.Current)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	l := New("test", "{{a", nil)
+	l.Next()
+	l.Advance(1)
+	if l.Current != 2 || l.Width != 0 {
+		t.Errorf("Expected current 2 and width 0, got %d and %d", l.Current, l.Width)
+	}
+	l.Backup()
+	if l.Current != 2 {
+		t.Errorf("Expected Backup after Advance to be a no-op, current %d", l.Current)
+	}
+
+	l.Advance(10)
+	if l.Current != len(l.Input) {
+		t.Errorf("Expected Advance to stop at the end of input, current %d", l.Current)
+	}
+	l.Emit(TokenText)
+	if tok := <-l.Tokens; tok.Typ != TokenText || tok.Val != "{{a" {
+		t.Errorf("Expected the whole input to be emitted, got %v", tok)
+	}
+}
+
+func TestLexError(t *testing.T) {
+	errorStateFn := func(l *Lexer) StateFn {
+		l.AcceptUntil("!")
+		l.Emit(TokenText)
+		return l.Errorf("unexpected %q", l.Peek())
+	}
+
+	_, err := New("test", "ab\nç!", errorStateFn).RunSyncE()
+	var lexErr *LexError
+	if !errors.As(err, &lexErr) {
+		t.Fatalf("Expected a *LexError, got %T", err)
+	}
+	expected := LexError{Name: "test", Msg: `unexpected '!'`, Offset: 5, Line: 2, Col: 2}
+	if *lexErr != expected {
+		t.Errorf("Expected %#v, got %#v", expected, *lexErr)
+	}
+	if err.Error() != `test:2:2: unexpected '!'` {
+		t.Errorf("Expected the token's message, got %q", err.Error())
+	}
+
+	s := New("test", "ab\nç!", errorStateFn).Stream()
+	for _, ok := s.Next(); ok; _, ok = s.Next() {
+	}
+	if !errors.As(s.Err(), &lexErr) || *lexErr != expected {
+		t.Errorf("Expected the stream to return %#v, got %#v", expected, s.Err())
+	}
+}
+
+func TestEmitRest(t *testing.T) {
+	l := New("test", "ab{{ broken", func(l *Lexer) StateFn {
+		l.Next()
+		l.Ignore()
+		l.EmitRest(TokenText)
+		l.EmitRest(TokenText)
+		return l.EmitThen(TokenEOF, nil)
+	})
+	tokens := l.AllTokens()
+	expected := []Token{
+		{Typ: TokenText, Val: "b{{ broken", Line: 1, Column: 2, Start: 1, End: 11},
+		{Typ: TokenText, Line: 1, Column: 12, Start: 11, End: 11},
+		{Typ: TokenEOF, Line: 1, Column: 12, Start: 11, End: 11},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, tokens)
+	}
+	for i := range expected {
+		if !tokens[i].EqualPos(expected[i]) {
+			t.Errorf("Expected %#v, got %#v", expected[i], tokens[i])
+		}
+	}
+}
+
+func TestRegisterReservedTokenName(t *testing.T) {
+	for _, tt := range []TokenType{TokenEOF, TokenError, -3} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected registering %d to panic", int(tt))
+				}
+			}()
+			RegisterTokenName(tt, "TokenCustom")
+		}()
+	}
+	if TokenEOF.String() != "TokenEOF" || TokenError.String() != "TokenError" {
+		t.Errorf("Expected the sentinel names to be unchanged, got %s and %s", TokenEOF, TokenError)
+	}
+}
+
+func TestSkipTo(t *testing.T) {
+	l := New("test", "bad ¿ input; next", nil)
+	l.Next()
+	if !l.SkipTo(';') || l.Current != 12 || l.Width != 0 {
+		t.Errorf("Expected to stop before ';' at 12 with width 0, got %d and %d", l.Current, l.Width)
+	}
+	if !l.SkipTo(';') || l.Current != 12 {
+		t.Errorf("Expected to stay before ';', current %d", l.Current)
+	}
+	if l.SkipTo('!') || l.Current != len(l.Input) {
+		t.Errorf("Expected to reach the end of input, current %d", l.Current)
+	}
+
+	l = New("test", "caf\xe9;", nil)
+	l.DecodeRune = func(s string) (rune, int) {
+		return rune(s[0]), 1
+	}
+	if !l.SkipTo('é') || l.Current != 3 {
+		t.Errorf("Expected to find 'é' with DecodeRune, current %d", l.Current)
+	}
+}
+
+func TestNextTokenSafe(t *testing.T) {
+	input := strings.Repeat(testString, 50)
+	expected := New("test", input, mockTextStateFn).AllTokens()
+
+	l := New("test", input, mockTextStateFn)
+	results := make(chan []Token)
+	for i := 0; i < 4; i++ {
+		go func() {
+			var tokens []Token
+			for {
+				tok, done := l.NextTokenSafe()
+				if done {
+					results <- tokens
+					return
+				}
+				tokens = append(tokens, tok)
+			}
+		}()
+	}
+
+	seen := make(map[int]Token)
+	for i := 0; i < 4; i++ {
+		for _, tok := range <-results {
+			if _, dup := seen[tok.Start]; dup {
+				t.Errorf("Expected each token once, got %v twice", tok)
+			}
+			seen[tok.Start] = tok
+		}
+	}
+	for _, want := range expected[:len(expected)-1] {
+		if got, ok := seen[want.Start]; !ok || got != want {
+			t.Errorf("Expected %#v to be consumed, got %#v", want, got)
+		}
+	}
+}
+
+func TestPeekNoMutate(t *testing.T) {
+	l := New("test", "éa", nil)
+	l.Next()
+	if r := l.PeekNoMutate(); r != 'a' {
+		t.Errorf("Expected 'a', got %q", r)
+	}
+	l.Backup()
+	if l.Current != 0 {
+		t.Errorf("Expected Backup after PeekNoMutate to step back over 'é', current %d", l.Current)
+	}
+
+	l.Current = len(l.Input)
+	if r := l.PeekNoMutate(); r != EOF {
+		t.Errorf("Expected EOF, got %q", r)
+	}
+}
+
+func TestNewFromFile(t *testing.T) {
+	l, err := NewFromFile("./test/fixtures/plaintext", mockTextStateFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.ReadFile("./test/fixtures/plaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Name != "plaintext" || l.Input != string(f) {
+		t.Errorf("Expected a lexer named plaintext over the file, got %q with %d bytes", l.Name, len(l.Input))
+	}
+
+	if _, err := NewFromFile("./test/fixtures/missing", mockTextStateFn); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	for _, size := range []int{1, 4} {
+		l := New("test", strings.Repeat("o", 1000), mockTextStateFn)
+		l.SetBatchSize(size)
+		l.RunAsync()
+		if tok, _ := l.Listen(); tok.Typ != TokenCharO {
+			t.Fatalf("Expected a char o, got %v", tok)
+		}
+
+		l.Close()
+		l.Close()
+		n := 0
+		for _, done := l.Listen(); !done; _, done = l.Listen() {
+			n++
+		}
+		if n >= 999 {
+			t.Errorf("batch size %d: expected the lexer to stop early, read %d more tokens", size, n)
+		}
+	}
+
+	l := New("test", "", mockTextStateFn)
+	l.Close()
+	l.RunConc()
+	if _, ok := <-l.Tokens; ok {
+		t.Error("Expected a closed lexer to close its channel without running")
+	}
+}
+
+func TestAcceptRange(t *testing.T) {
+	l := New("test", "7f9δεζx", nil)
+	if !l.AcceptRange('0', '9') || l.Current != 1 {
+		t.Errorf("Expected a digit to be accepted, current %d", l.Current)
+	}
+	if l.AcceptRange('0', '9') || l.Current != 1 {
+		t.Errorf("Expected 'f' not to be accepted, current %d", l.Current)
+	}
+	if n := l.AcceptRangeRun('0', 'f'); n != 2 || l.Current != 3 {
+		t.Errorf("Expected 2 hex digits, got %d and current %d", n, l.Current)
+	}
+	if n := l.AcceptRangeRun('α', 'ω'); n != 3 || l.Current != 9 {
+		t.Errorf("Expected 3 Greek letters, got %d and current %d", n, l.Current)
+	}
+	l.Current = len(l.Input)
+	if l.AcceptRange(EOF, 'z') {
+		t.Error("Expected nothing to be accepted at the end of input")
+	}
+}
+
+func TestPrefixDispatchState(t *testing.T) {
+	var textStateFn StateFn
+	emitPrefix := func(prefix string, tt TokenType) StateFn {
+		return func(l *Lexer) StateFn {
+			l.Advance(len(prefix))
+			return l.EmitThen(tt, textStateFn)
+		}
+	}
+	textStateFn = PrefixDispatchState(map[string]StateFn{
+		"{":  emitPrefix("{", TokenCharO),
+		"{{": emitPrefix("{{", TokenOpenBlock),
+		"}}": emitPrefix("}}", TokenCloseBlock),
+	}, TokenText)
+
+	tokens := New("test", "a{b{{c}}", textStateFn).AllTokens()
+	expected := []Token{
+		{Typ: TokenText, Val: "a"},
+		{Typ: TokenCharO, Val: "{"},
+		{Typ: TokenText, Val: "b"},
+		{Typ: TokenOpenBlock, Val: "{{"},
+		{Typ: TokenText, Val: "c"},
+		{Typ: TokenCloseBlock, Val: "}}"},
+		{Typ: TokenEOF},
+	}
+	if !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+}
+
+func TestUserData(t *testing.T) {
+	type blockDepth struct{ depth, deepest int }
+
+	var braceStateFn StateFn
+	braceStateFn = func(l *Lexer) StateFn {
+		d := l.UserData.(*blockDepth)
+		switch l.Next() {
+		case '{':
+			d.depth++
+			if d.depth > d.deepest {
+				d.deepest = d.depth
+			}
+		case '}':
+			d.depth--
+		case EOF:
+			return nil
+		}
+		return braceStateFn
+	}
+
+	lexers := []*Lexer{New("a", "{{}{{{}}}}", braceStateFn), New("b", "{}{}", braceStateFn)}
+	for _, l := range lexers {
+		l.UserData = &blockDepth{}
+	}
+	for _, l := range lexers {
+		l.AllTokens()
+	}
+	if d := lexers[0].UserData.(*blockDepth); d.depth != 0 || d.deepest != 4 {
+		t.Errorf("Expected depth 0 and deepest 4, got %+v", *d)
+	}
+	if d := lexers[1].UserData.(*blockDepth); d.depth != 0 || d.deepest != 1 {
+		t.Errorf("Expected depth 0 and deepest 1, got %+v", *d)
+	}
+}
+
+func TestTypedLexer(t *testing.T) {
+	type mode struct {
+		inBlock bool
+		blocks  int
+	}
+
+	var modeStateFn StateFn
+	modeStateFn = func(l *Lexer) StateFn {
+		m := &TypedFrom[mode](l).Data
+		switch {
+		case l.AcceptString(openBlock):
+			m.inBlock = true
+			m.blocks++
+		case l.AcceptString(closeBlock):
+			m.inBlock = false
+		case l.Next() == EOF:
+			return nil
+		}
+		return modeStateFn
+	}
+
+	l := NewTyped("test", "a{{b}}{{c", modeStateFn, mode{})
+	l.AllTokens()
+	if !l.Data.inBlock || l.Data.blocks != 2 {
+		t.Errorf("Expected to end inside the second block, got %+v", l.Data)
+	}
+
+	if TypedFrom[int](l.Lexer) != nil {
+		t.Error("Expected no TypedLexer for a different type")
+	}
+	if TypedFrom[mode](New("test", "", nil)) != nil {
+		t.Error("Expected no TypedLexer for a plain lexer")
+	}
+}
+
+func TestRemainingCounts(t *testing.T) {
+	l := New("test", "aé€", nil)
+	if l.RemainingBytes() != 6 || l.RemainingRunes() != 3 {
+		t.Errorf("Expected 6 bytes and 3 runes, got %d and %d", l.RemainingBytes(), l.RemainingRunes())
+	}
+	l.Next()
+	l.Next()
+	if l.RemainingBytes() != 3 || l.RemainingRunes() != 1 {
+		t.Errorf("Expected 3 bytes and 1 rune, got %d and %d", l.RemainingBytes(), l.RemainingRunes())
+	}
+	if l.Current != 3 || l.Width != 2 {
+		t.Errorf("Expected the counts not to change the lexer, got current %d width %d", l.Current, l.Width)
+	}
+}
+
+func TestEmitFrom(t *testing.T) {
+	var stringStateFn, interpStateFn StateFn
+	var mark int
+	stringStateFn = func(l *Lexer) StateFn {
+		if l.AcceptRune('"') {
+			mark = l.Mark() - 1
+			l.Ignore()
+		}
+		for {
+			switch l.Next() {
+			case '$':
+				return interpStateFn
+			case '"':
+				l.EmitFrom(mark, TokenText)
+				return l.EmitThen(TokenEOF, nil)
+			case EOF:
+				return l.Errorf("unterminated string")
+			}
+		}
+	}
+	interpStateFn = func(l *Lexer) StateFn {
+		l.AcceptWhile(IsAlpha)
+		l.Ignore()
+		return stringStateFn
+	}
+
+	tokens := New("test", `"a $b c"`, stringStateFn).AllTokens()
+	if len(tokens) != 2 || tokens[0].Val != `"a $b c"` || tokens[0].Start != 0 || tokens[0].End != 8 {
+		t.Errorf("Expected the whole string as one token, got %#v", tokens)
+	}
+
+	l := New("test", "ab", nil)
+	l.Next()
+	l.EmitFrom(2, TokenText)
+	if tok := <-l.Tokens; tok.Typ != TokenError {
+		t.Errorf("Expected an error for a mark past the current position, got %v", tok)
+	}
+}
+
+func TestNewlineState(t *testing.T) {
+	var textStateFn StateFn
+	textStateFn = func(l *Lexer) StateFn {
+		l.AcceptWhile(func(r rune) bool { return r != '\r' && r != '\n' })
+		l.EmitPending(TokenText)
+		if l.Current == len(l.Input) {
+			return l.EmitThen(TokenEOF, nil)
+		}
+		return NewlineState(TokenNewLine, textStateFn)
+	}
+
+	tokens := New("test", "a\r\nb\nc\rd\n\r", textStateFn).AllTokens()
+	expected := []Token{
+		{Typ: TokenText, Val: "a"},
+		{Typ: TokenNewLine, Val: "\r\n"},
+		{Typ: TokenText, Val: "b"},
+		{Typ: TokenNewLine, Val: "\n"},
+		{Typ: TokenText, Val: "c"},
+		{Typ: TokenNewLine, Val: "\r"},
+		{Typ: TokenText, Val: "d"},
+		{Typ: TokenNewLine, Val: "\n"},
+		{Typ: TokenNewLine, Val: "\r"},
+		{Typ: TokenEOF},
+	}
+	if !TokensEqual(tokens, expected) {
+		t.Errorf("Expected %v, got %v", expected, tokens)
+	}
+}
+
+func TestCloneDuringScan(t *testing.T) {
+	var clone *Lexer
+	var scanned []Token
+	l := New("test", "ab", func(l *Lexer) StateFn {
+		clone = l.Clone()
+		return nil
+	})
+	l.Scan(func(tok Token) bool {
+		scanned = append(scanned, tok)
+		return true
+	})
+	for _, tok := range scanned {
+		if tok.Typ == TokenText {
+			t.Errorf("Expected none of the clone's tokens in the parent's callback, got %v", scanned)
+		}
+	}
+
+	clone.InitialState = func(l *Lexer) StateFn {
+		l.AcceptUntil("\x00")
+		l.Emit(TokenText)
+		return nil
+	}
+	clone.State = clone.InitialState
+	clone.RunConc()
+	var tokens []Token
+	for tok := range clone.Tokens {
+		tokens = append(tokens, tok)
+	}
+	if !TokensEqual(tokens, []Token{{Typ: TokenText, Val: "ab"}, {Typ: TokenEOF}}) {
+		t.Errorf("Expected the clone's tokens on its own channel, got %v", tokens)
+	}
+}
+
+func TestTypedLexerClone(t *testing.T) {
+	l := NewTyped("test", "ab", nil, 1)
+
+	c := l.Lexer.Clone()
+	tc := TypedFrom[int](c)
+	if tc == nil || tc.Lexer != c || tc == l {
+		t.Fatalf("Expected the clone to have its own TypedLexer, got %+v", tc)
+	}
+	tc.Data = 2
+	if l.Data != 1 {
+		t.Errorf("Expected the original's data to be unchanged, got %d", l.Data)
+	}
+
+	if c2 := l.Clone(); c2.Lexer == l.Lexer || c2.Data != 1 || TypedFrom[int](c2.Lexer) != c2 {
+		t.Errorf("Expected TypedLexer.Clone to wrap a new lexer, got %+v", c2)
+	}
+}
+
+func TestCloseFromState(t *testing.T) {
+	l := New("test", "ab", func(l *Lexer) StateFn {
+		l.Close()
+		l.AcceptUntil("\x00")
+		return l.EmitThen(TokenText, nil)
+	})
+
+	result := make(chan Token, 1)
+	go func() {
+		tok, _ := l.NextTokenSafe()
+		result <- tok
+	}()
+	select {
+	case tok := <-result:
+		if tok.Val != "ab" {
+			t.Errorf("Expected the text token, got %v", tok)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close from a state run by NextTokenSafe not to deadlock")
+	}
+}
+
+func TestTriviaHandlerWithBase(t *testing.T) {
+	var trivia [][2]int
+	l := NewAt("test", "  a", func(l *Lexer) StateFn {
+		l.SkipSpaces()
+		l.AcceptWhile(IsAlpha)
+		return l.EmitThen(TokenText, nil)
+	}, 100)
+	l.SetTriviaHandler(func(start, end int) {
+		trivia = append(trivia, [2]int{start, end})
+	})
+	tok, _ := l.NextToken()
+
+	if len(trivia) != 1 || trivia[0] != [2]int{100, 102} {
+		t.Errorf("Expected trivia at [100:102], got %v", trivia)
+	}
+	if tok.Start != trivia[0][1] {
+		t.Errorf("Expected the token to start where the trivia ends, got %d", tok.Start)
+	}
 }
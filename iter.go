@@ -0,0 +1,19 @@
+//go:build go1.23
+
+package golex
+
+import "iter"
+
+// Iter returns an iterator over the lexer's tokens for use with range.
+// The lexer runs synchronously as tokens are pulled, and iteration stops
+// after yielding the final TokenEOF or TokenError.
+func (l *Lexer) Iter() iter.Seq[Token] {
+	return func(yield func(Token) bool) {
+		for {
+			tok, done := l.NextToken()
+			if !yield(tok) || done || tok.Typ == TokenError {
+				return
+			}
+		}
+	}
+}
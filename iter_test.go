@@ -0,0 +1,26 @@
+//go:build go1.23
+
+package golex
+
+import "testing"
+
+func TestIter(t *testing.T) {
+	var out string
+	for tok := range New("test", testString, mockTextStateFn).Iter() {
+		out += tok.String()
+	}
+	if out != testString+"EOF" {
+		t.Errorf("Expected %q, got %q", testString+"EOF", out)
+	}
+
+	count := 0
+	for range New("test", testString, mockTextStateFn).Iter() {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected iteration to stop after break, got %d tokens", count)
+	}
+}
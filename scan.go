@@ -0,0 +1,160 @@
+package golex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scanners for common lexical elements, built on the Lexer helpers.
+// Each leaves the scanned text pending so the caller can Emit it.
+
+// ScanNumber consumes an integer or floating point literal: an optional sign,
+// decimal digits, an optional fraction and an optional exponent.
+// A '.' is only consumed when a digit follows it, so "1." scans as "1" and a
+// lone "." is not a number. An 'e' or 'E' is likewise only consumed as part
+// of a complete exponent. If no number is found nothing is consumed.
+func (l *Lexer) ScanNumber() bool {
+	start := l.Current
+	l.Accept("+-")
+	digits := l.AcceptWhile(isDecimal)
+	if l.NextHasPrefix(".") {
+		l.Current++
+		if n := l.AcceptWhile(isDecimal); n > 0 {
+			digits += n
+		} else {
+			l.Current--
+		}
+	}
+	if digits == 0 {
+		l.Current = start
+		return false
+	}
+	if mark := l.Current; l.Accept("eE") {
+		l.Accept("+-")
+		if l.AcceptWhile(isDecimal) == 0 {
+			l.Current = mark
+		}
+	}
+	l.Width = 0
+	return true
+}
+
+// ScanQuotedString consumes a string literal delimited by quote, starting
+// on the opening quote, and returns its value with escapes interpreted.
+// The escapes \n, \t, \r, \\ and a backslash before quote are supported.
+// An unknown escape or a missing closing quote returns an error, which the
+// caller can report with Errorf.
+func (l *Lexer) ScanQuotedString(quote rune) (string, error) {
+	start := l.Current
+	if l.Next() != quote {
+		l.Backup()
+		return "", fmt.Errorf("expected %q at offset %d", quote, start)
+	}
+	var b strings.Builder
+	for {
+		switch r := l.Next(); r {
+		case EOF:
+			return "", fmt.Errorf("unterminated string starting at offset %d", start)
+		case quote:
+			return b.String(), nil
+		case '\\':
+			switch e := l.Next(); e {
+			case 'n':
+				b.WriteRune('\n')
+			case 't':
+				b.WriteRune('\t')
+			case 'r':
+				b.WriteRune('\r')
+			case '\\', quote:
+				b.WriteRune(e)
+			case EOF:
+				return "", fmt.Errorf("unterminated string starting at offset %d", start)
+			default:
+				return "", fmt.Errorf("unknown escape sequence \\%c at offset %d", e, l.Current-l.Width-1)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// ScanDelimited consumes a balanced construct from an open rune to its
+// matching close rune, starting on the open rune, and returns the deepest
+// level of nesting reached, so "(a)" gives 1 and "((a) b)" gives 2.
+// Reaching the end of input while unbalanced returns an error, which the
+// caller can report with Errorf. open and close must differ.
+func (l *Lexer) ScanDelimited(open, close rune) (int, error) {
+	start := l.Current
+	if l.Next() != open {
+		l.Backup()
+		return 0, fmt.Errorf("expected %q at offset %d", open, start)
+	}
+	depth, deepest := 1, 1
+	for depth > 0 {
+		switch l.Next() {
+		case EOF:
+			return deepest, fmt.Errorf("unbalanced %q starting at offset %d", open, start)
+		case open:
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case close:
+			depth--
+		}
+	}
+	l.Width = 0
+	return deepest, nil
+}
+
+// ScanIdentifier consumes a letter or '_' followed by any run of letters,
+// digits and '_', and returns the scanned identifier. Letters and digits
+// are Unicode ones, as matched by IsAlpha and IsDigit. If the next rune
+// cannot start an identifier nothing is consumed and "" is returned.
+func (l *Lexer) ScanIdentifier() string {
+	start := l.Current
+	if !l.PeekIs(isIdentStart) {
+		return ""
+	}
+	l.AcceptWhile(isIdentPart)
+	l.Width = 0
+	return l.Input[start:l.Current]
+}
+
+// SkipBOM skips a UTF-8 byte order mark at the very start of the input,
+// reporting whether there was one
+func (l *Lexer) SkipBOM() bool {
+	if l.Current != 0 || !l.NextHasPrefix("\uFEFF") {
+		return false
+	}
+	l.Current += len("\uFEFF")
+	l.Ignore()
+	return true
+}
+
+// ScanShebang consumes a "#!" interpreter line, such as "#!/bin/sh", up to
+// but not including its line ending, and returns it. It should be called at
+// the start of the input, after any SkipBOM. If the input doesn't continue
+// with "#!" nothing is consumed.
+func (l *Lexer) ScanShebang() (string, bool) {
+	start := l.Current
+	if !l.AcceptString("#!") {
+		return "", false
+	}
+	l.AcceptUntil("\n")
+	line := strings.TrimSuffix(l.Input[start:l.Current], "\r")
+	l.Current = start + len(line)
+	return line, true
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || IsAlpha(r)
+}
+
+func isIdentPart(r rune) bool {
+	return r == '_' || IsAlphaNumeric(r)
+}
+
+func isDecimal(r rune) bool {
+	return '0' <= r && r <= '9'
+}
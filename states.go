@@ -0,0 +1,100 @@
+package golex
+
+import "sort"
+
+// Ready-made state functions for common lexical elements.
+// Each is a factory taking the state to continue with, so it can be wired
+// into any state graph.
+
+// WhitespaceState returns a state function that skips a run of whitespace,
+// as matched by IsSpace, and continues with next. Any pending text is
+// ignored along with the whitespace, so emit it before entering the state.
+func WhitespaceState(next StateFn) StateFn {
+	return func(l *Lexer) StateFn {
+		l.SkipSpaces()
+		return next
+	}
+}
+
+// LineCommentState returns a state function that skips a comment starting
+// with marker, such as "//", up to but not including the end of the line,
+// and continues with next. If the input doesn't start with marker nothing
+// is skipped. Any pending text is ignored along with the comment, so emit
+// it before entering the state.
+func LineCommentState(marker string, next StateFn) StateFn {
+	return func(l *Lexer) StateFn {
+		if l.AcceptString(marker) {
+			l.AcceptUntil("\n")
+			l.Ignore()
+		}
+		return next
+	}
+}
+
+// BlockCommentState returns a state function that skips a comment from open
+// to close, such as "/*" and "*/", and continues with next. Comments don't
+// nest. Reaching the end of input before close emits an
+// "unterminated block comment" error and ends the scan. If the input
+// doesn't start with open nothing is skipped. Any pending text is ignored
+// along with the comment, so emit it before entering the state.
+func BlockCommentState(open, close string, next StateFn) StateFn {
+	return func(l *Lexer) StateFn {
+		if !l.AcceptString(open) {
+			return next
+		}
+		if s := l.AcceptUntilOrError(close, "block comment"); s != nil {
+			return s
+		}
+		l.AcceptString(close)
+		l.Ignore()
+		return next
+	}
+}
+
+// PrefixDispatchState returns a state function that consumes text until it
+// reaches one of the prefixes in table, then emits the pending text as a
+// defaultText token and continues with that prefix's state, which is left
+// to consume the prefix itself. When several prefixes match, the longest
+// wins, so "{{" is chosen over "{". At the end of input the pending text
+// and a TokenEOF are emitted and the scan ends.
+func PrefixDispatchState(table map[string]StateFn, defaultText TokenType) StateFn {
+	prefixes := make([]string, 0, len(table))
+	for p := range table {
+		if p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	return func(l *Lexer) StateFn {
+		for {
+			for _, p := range prefixes {
+				if l.NextHasPrefix(p) {
+					l.EmitPending(defaultText)
+					return table[p]
+				}
+			}
+			if l.Next() == EOF {
+				break
+			}
+		}
+		l.EmitPending(defaultText)
+		l.Emit(TokenEOF)
+		return nil
+	}
+}
+
+// NewlineState returns a state function that consumes one line ending,
+// "\r\n", "\n" or "\r", emits it as a single token of type tt and
+// continues with next, so "\r\n" never yields two line tokens. If the
+// input doesn't continue with a line ending nothing is emitted.
+func NewlineState(tt TokenType, next StateFn) StateFn {
+	return func(l *Lexer) StateFn {
+		if l.AcceptString("\r\n") || l.AcceptRune('\n') || l.AcceptRune('\r') {
+			l.Emit(tt)
+		}
+		return next
+	}
+}
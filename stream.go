@@ -0,0 +1,54 @@
+package golex
+
+// TokenStream pulls tokens from a lexer, running it synchronously as
+// tokens are requested, and records any error that ends the scan.
+type TokenStream struct {
+	l    *Lexer
+	skip map[TokenType]bool
+	err  error
+	done bool
+}
+
+// Stream returns a TokenStream reading from the lexer
+func (l *Lexer) Stream() *TokenStream {
+	return &TokenStream{l: l}
+}
+
+// Filter returns a TokenStream that drops tokens of the given types, such as
+// whitespace and comments, as they are pulled. TokenEOF and TokenError are
+// always passed through so the stream still ends and reports errors.
+func (l *Lexer) Filter(skip ...TokenType) *TokenStream {
+	s := &TokenStream{l: l, skip: make(map[TokenType]bool, len(skip))}
+	for _, tt := range skip {
+		if tt != TokenEOF && tt != TokenError {
+			s.skip[tt] = true
+		}
+	}
+	return s
+}
+
+// Next returns the next token and true, or the final TokenEOF or
+// TokenError and false once the scan has ended.
+// After an error token, Err returns the error as a *LexError.
+func (s *TokenStream) Next() (Token, bool) {
+	if s.done {
+		return Token{Typ: TokenEOF}, false
+	}
+	tok, done := s.l.NextToken()
+	for !done && s.skip[tok.Typ] {
+		tok, done = s.l.NextToken()
+	}
+	switch {
+	case tok.Typ == TokenError:
+		s.err = s.l.lexError(tok)
+		s.done = true
+	case done:
+		s.done = true
+	}
+	return tok, !s.done
+}
+
+// Err returns the error that ended the scan, or nil if it ended at EOF
+func (s *TokenStream) Err() error {
+	return s.err
+}
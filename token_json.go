@@ -0,0 +1,83 @@
+package golex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// tokenJSON is the serialised form of a Token
+type tokenJSON struct {
+	Type   json.RawMessage `json:"type"`
+	Value  string          `json:"value"`
+	Line   int             `json:"line"`
+	Column int             `json:"column"`
+	Start  int             `json:"start"`
+	End    int             `json:"end"`
+}
+
+// MarshalJSON encodes the token type by its registered name, or as a number
+// when no name has been registered.
+// json.Marshal escapes HTML characters in values; encode with a json.Encoder
+// and SetEscapeHTML(false) to keep them readable.
+func (t Token) MarshalJSON() ([]byte, error) {
+	var typ interface{} = int(t.Typ)
+	if name, ok := tokenNames[t.Typ]; ok {
+		typ = name
+	}
+	rawType, err := json.Marshal(typ)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(tokenJSON{
+		Type:   rawType,
+		Value:  t.Val,
+		Line:   t.Line,
+		Column: t.Column,
+		Start:  t.Start,
+		End:    t.End,
+	})
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), err
+}
+
+// UnmarshalJSON decodes a token written by MarshalJSON.
+// A type name must have been registered with RegisterTokenName.
+func (t *Token) UnmarshalJSON(data []byte) error {
+	var tj tokenJSON
+	if err := json.Unmarshal(data, &tj); err != nil {
+		return err
+	}
+	typ, err := unmarshalTokenType(tj.Type)
+	if err != nil {
+		return err
+	}
+	*t = Token{
+		Typ:    typ,
+		Val:    tj.Value,
+		Line:   tj.Line,
+		Column: tj.Column,
+		Start:  tj.Start,
+		End:    tj.End,
+	}
+	return nil
+}
+
+func unmarshalTokenType(data json.RawMessage) (TokenType, error) {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		return TokenType(n), nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return 0, fmt.Errorf("golex: token type must be a name or number, got %s", data)
+	}
+	for tt, registered := range tokenNames {
+		if registered == name {
+			return tt, nil
+		}
+	}
+	return 0, fmt.Errorf("golex: unknown token type name %q", name)
+}
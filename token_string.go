@@ -2,6 +2,32 @@ package golex
 
 import "fmt"
 
+// tokenNames holds the human readable names registered for token types.
+// It is only written by RegisterTokenName, so concurrent reads are safe once
+// registration has finished.
+var tokenNames = map[TokenType]string{
+	TokenEOF:   "TokenEOF",
+	TokenError: "TokenError",
+}
+
+// RegisterTokenName sets the name used when printing tokens of type tt.
+// Register names during package initialisation, before lexing starts.
+// It panics if tt is negative, as negative types are reserved for
+// TokenEOF, TokenError and any sentinels the package adds later.
+func RegisterTokenName(tt TokenType, name string) {
+	if tt < 0 {
+		panic(fmt.Sprintf("golex: token type %d is reserved", int(tt)))
+	}
+	tokenNames[tt] = name
+}
+
+func (tt TokenType) String() string {
+	if name, ok := tokenNames[tt]; ok {
+		return name
+	}
+	return fmt.Sprintf("TokenType(%d)", int(tt))
+}
+
 func (t Token) String() string {
 	switch t.Typ {
 	case TokenEOF:
@@ -9,8 +35,14 @@ func (t Token) String() string {
 	case TokenError:
 		return t.Val
 	}
+	if name, ok := tokenNames[t.Typ]; ok {
+		if len(t.Val) > 200 {
+			return fmt.Sprintf("%s(%.200q...)", name, t.Val)
+		}
+		return fmt.Sprintf("%s(%q)", name, t.Val)
+	}
 	if len(t.Val) > 200 {
 		return fmt.Sprintf("%.200q...", t.Val)
 	}
 	return fmt.Sprintf("%s", t.Val)
-}
\ No newline at end of file
+}
@@ -0,0 +1,45 @@
+package golex
+
+// TypedLexer pairs a lexer with caller data of type T, giving state
+// functions compile-time typed context in place of UserData assertions.
+type TypedLexer[T any] struct {
+	*Lexer
+	Data T
+}
+
+// userDataCloner is implemented by UserData that must not be shared
+// between a lexer and its clones
+type userDataCloner interface {
+	cloneFor(c *Lexer) interface{}
+}
+
+// NewTyped creates a lexer, as New does, carrying data. State functions,
+// which still receive the plain *Lexer, reach the data through TypedFrom.
+func NewTyped[T any](name, input string, initialState StateFn, data T) *TypedLexer[T] {
+	t := &TypedLexer[T]{Lexer: New(name, input, initialState), Data: data}
+	t.UserData = t
+	return t
+}
+
+// TypedFrom returns the TypedLexer that l belongs to, for use inside state
+// functions. It returns nil if l was not created by NewTyped with the same
+// type T, or cloned from such a lexer, or if its UserData has since been
+// replaced.
+func TypedFrom[T any](l *Lexer) *TypedLexer[T] {
+	if t, ok := l.UserData.(*TypedLexer[T]); ok && t.Lexer == l {
+		return t
+	}
+	return nil
+}
+
+// Clone is like Lexer.Clone, returning a TypedLexer over the cloned lexer
+// with a copy of Data
+func (t *TypedLexer[T]) Clone() *TypedLexer[T] {
+	return TypedFrom[T](t.Lexer.Clone())
+}
+
+// cloneFor gives a clone of the lexer its own TypedLexer, so that TypedFrom
+// on the clone doesn't return the original's
+func (t *TypedLexer[T]) cloneFor(c *Lexer) interface{} {
+	return &TypedLexer[T]{Lexer: c, Data: t.Data}
+}